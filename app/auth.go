@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"strings"
+)
+
+// authRealm is sent in the basic auth challenge
+const authRealm = "files"
+
+// requireAuth wraps fn so that it is only called for requests carrying the
+// credentials given with -auth. It returns fn unchanged if -auth is unset.
+func requireAuth(fn HandlerFunc) HandlerFunc {
+	if auth == "" {
+		return fn
+	}
+	return func(ctx context.Context, req *Req) *Res {
+		if !checkBasicAuth(req.Headers.Get("authorization"), auth) {
+			return Unauthorized(authRealm)
+		}
+		return fn(ctx, req)
+	}
+}
+
+// checkBasicAuth reports whether an authorization header holds basic
+// credentials equal to userPass, which is of the form user:pass
+func checkBasicAuth(header, userPass string) bool {
+	scheme, encoded, ok := strings.Cut(strings.TrimSpace(header), " ")
+	if !ok || !strings.EqualFold(scheme, "basic") {
+		return false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(decoded, []byte(userPass)) == 1
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+// basic returns an authorization header line carrying userPass
+func basic(userPass string) string {
+	return "Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(userPass))
+}
+
+func TestBasicAuth(t *testing.T) {
+	serveFiles(t)
+	set(t, &auth, "alice:s3cret")
+	addr := startServer(t)
+	for name, tc := range map[string]struct {
+		headers []string
+		want    int
+	}{
+		"missing":    {nil, 401},
+		"wrong":      {[]string{basic("alice:nope")}, 401},
+		"not basic":  {[]string{"Authorization: Bearer alice:s3cret"}, 401},
+		"bad base64": {[]string{"Authorization: Basic !!"}, 401},
+		"correct":    {[]string{basic("alice:s3cret")}, 404},
+	} {
+		res, _ := do(t, addr, rawRequest("GET", "/files/none", "", tc.headers...))
+		if res.StatusCode != tc.want {
+			t.Errorf("%s credentials: status = %d, want %d", name, res.StatusCode, tc.want)
+		}
+		if tc.want == 401 && res.Header.Get("WWW-Authenticate") != `Basic realm="files"` {
+			t.Errorf("%s credentials: challenge = %q", name, res.Header.Get("WWW-Authenticate"))
+		}
+	}
+	// only the files routes are protected
+	if res, _ := do(t, addr, rawRequest("GET", "/echo/x", "")); res.StatusCode != 200 {
+		t.Errorf("GET /echo/x without credentials = %d, want 200", res.StatusCode)
+	}
+}
+
+func TestUnauthorizedChallenge(t *testing.T) {
+	got := Unauthorized("admin area").String()
+	if !strings.HasPrefix(got, "HTTP/1.1 401 Unauthorized\r\n") || !strings.Contains(got, "\r\nWWW-Authenticate: Basic realm=\"admin area\"\r\n") {
+		t.Errorf("Unauthorized renders as:\n%s", got)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/url"
+)
+
+// hasMediaType reports whether the request's content-type is mediaType,
+// ignoring parameters like charset
+func (r *Req) hasMediaType(mediaType string) bool {
+	mt, _, err := mime.ParseMediaType(r.Headers.Get("content-type"))
+	return err == nil && mt == mediaType
+}
+
+// JSON decodes a JSON request body into v. The returned error is a
+// StatusError suitable for sending back to the client.
+func (r *Req) JSON(v interface{}) error {
+	if !r.hasMediaType("application/json") {
+		return &StatusError{415, "Expected content-type application/json"}
+	}
+	if err := json.Unmarshal(r.Body, v); err != nil {
+		return &StatusError{400, "Invalid JSON body: " + err.Error()}
+	}
+	return nil
+}
+
+// ParseForm decodes an application/x-www-form-urlencoded request body into
+// every value sent for each key
+func (r *Req) ParseForm() (map[string][]string, error) {
+	if !r.hasMediaType("application/x-www-form-urlencoded") {
+		return nil, &StatusError{415, "Expected content-type application/x-www-form-urlencoded"}
+	}
+	values, err := url.ParseQuery(string(r.Body))
+	if err != nil {
+		return nil, &StatusError{400, "Malformed form body"}
+	}
+	return values, nil
+}
+
+// UploadedFile is a part of a multipart/form-data body
+type UploadedFile struct {
+	Field    string
+	Filename string // empty for plain form fields
+	Data     []byte
+}
+
+// ParseMultipart splits a multipart/form-data request body into its parts
+func (r *Req) ParseMultipart() ([]UploadedFile, error) {
+	mt, params, err := mime.ParseMediaType(r.Headers.Get("content-type"))
+	if err != nil || mt != "multipart/form-data" {
+		return nil, &StatusError{415, "Expected content-type multipart/form-data"}
+	}
+	if params["boundary"] == "" {
+		return nil, &StatusError{400, "Missing multipart boundary"}
+	}
+
+	var files []UploadedFile
+	mr := multipart.NewReader(bytes.NewReader(r.Body), params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if errors.Is(err, io.EOF) {
+			return files, nil
+		}
+		if err != nil {
+			return nil, &StatusError{400, "Malformed multipart body: " + err.Error()}
+		}
+		data, err := io.ReadAll(part)
+		if err != nil {
+			return nil, &StatusError{400, "Malformed multipart body: " + err.Error()}
+		}
+		files = append(files, UploadedFile{
+			Field:    part.FormName(),
+			Filename: part.FileName(),
+			Data:     data,
+		})
+	}
+}
+
+// ParseBody decodes the request body according to its content-type: JSON
+// into a generic value, forms into their values by key, multipart bodies
+// into their fields, and anything else into a string
+func (r *Req) ParseBody() (interface{}, error) {
+	mt, _, _ := mime.ParseMediaType(r.Headers.Get("content-type"))
+	switch mt {
+	case "application/json":
+		var v interface{}
+		err := r.JSON(&v)
+		return v, err
+	case "application/x-www-form-urlencoded":
+		return r.ParseForm()
+	case "multipart/form-data":
+		parts, err := r.ParseMultipart()
+		if err != nil {
+			return nil, err
+		}
+		fields := make(map[string][]string)
+		for _, part := range parts {
+			// files are summed up by their name rather than included whole
+			value := string(part.Data)
+			if part.Filename != "" {
+				value = part.Filename
+			}
+			fields[part.Field] = append(fields[part.Field], value)
+		}
+		return fields, nil
+	default:
+		return string(r.Body), nil
+	}
+}
+
+// JSONRes returns a response with v encoded as its JSON body
+func JSONRes(status uint, v interface{}) *Res {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return ErrRes(err, 500)
+	}
+	return &Res{
+		Status: status,
+		CType:  "application/json",
+		Body:   b,
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"testing"
+)
+
+// multipartBody encodes a form with the field note=hi and the file a.txt,
+// returning it and its content-type
+func multipartBody(t *testing.T) (string, string) {
+	t.Helper()
+	var b bytes.Buffer
+	mw := multipart.NewWriter(&b)
+	mw.WriteField("note", "hi")
+	fw, err := mw.CreateFormFile("file", "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write([]byte("file contents"))
+	mw.Close()
+	return b.String(), mw.FormDataContentType()
+}
+
+func TestReqJSON(t *testing.T) {
+	req := newReq("POST", "/api")
+	req.Headers.Add("Content-Type", "application/json; charset=utf-8")
+	req.Body = []byte(`{"name":"gopher","n":3}`)
+	var v struct {
+		Name string
+		N    int
+	}
+	if err := req.JSON(&v); err != nil {
+		t.Fatal(err)
+	}
+	if v.Name != "gopher" || v.N != 3 {
+		t.Errorf("decoded %+v, want gopher and 3", v)
+	}
+
+	req.Body = []byte(`{"name":`)
+	if err := req.JSON(&v); errStatus(err, 0) != 400 {
+		t.Errorf("invalid JSON = %v, want a 400 error", err)
+	}
+	req = newReq("POST", "/api")
+	req.Headers.Add("Content-Type", "text/plain")
+	req.Body = []byte(`{}`)
+	if err := req.JSON(&v); errStatus(err, 0) != 415 {
+		t.Errorf("text/plain body = %v, want a 415 error", err)
+	}
+}
+
+func TestJSONRes(t *testing.T) {
+	res := JSONRes(201, map[string]int{"n": 1})
+	if res.Status != 201 || res.CType != "application/json" || string(res.Body) != `{"n":1}` {
+		t.Errorf("JSONRes = %d %s %q, want 201 application/json {\"n\":1}", res.Status, res.CType, res.Body)
+	}
+	if res := JSONRes(200, make(chan int)); res.Status != 500 {
+		t.Errorf("JSONRes of a channel = %d, want 500", res.Status)
+	}
+}
+
+func TestParseForm(t *testing.T) {
+	req := newReq("POST", "/form")
+	req.Headers.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Body = []byte("tag=a&tag=b&msg=hello+world%21%26more")
+	form, err := req.ParseForm()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tags := form["tag"]; len(tags) != 2 || tags[0] != "a" || tags[1] != "b" {
+		t.Errorf("tag = %q, want [a b]", tags)
+	}
+	if msg := form["msg"]; len(msg) != 1 || msg[0] != "hello world!&more" {
+		t.Errorf("msg = %q, want [hello world!&more]", msg)
+	}
+
+	req.Body = []byte("bad=%zz")
+	if _, err := req.ParseForm(); errStatus(err, 0) != 400 {
+		t.Errorf("malformed form = %v, want a 400 error", err)
+	}
+	req.Headers = Header{}
+	if _, err := req.ParseForm(); errStatus(err, 0) != 415 {
+		t.Errorf("form without a content-type = %v, want a 415 error", err)
+	}
+}
+
+func TestParseMultipart(t *testing.T) {
+	body, ctype := multipartBody(t)
+	req := newReq("POST", "/upload")
+	req.Headers.Add("Content-Type", ctype)
+	req.Body = []byte(body)
+	parts, err := req.ParseMultipart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []UploadedFile{{"note", "", []byte("hi")}, {"file", "a.txt", []byte("file contents")}}
+	if len(parts) != len(want) {
+		t.Fatalf("got %d parts, want %d", len(parts), len(want))
+	}
+	for i, part := range parts {
+		if part.Field != want[i].Field || part.Filename != want[i].Filename || !bytes.Equal(part.Data, want[i].Data) {
+			t.Errorf("part %d = %s %q %q, want %s %q %q", i, part.Field, part.Filename, part.Data, want[i].Field, want[i].Filename, want[i].Data)
+		}
+	}
+
+	req.Headers = Header{}
+	req.Headers.Add("Content-Type", "multipart/form-data")
+	if _, err := req.ParseMultipart(); errStatus(err, 0) != 400 {
+		t.Errorf("multipart without a boundary = %v, want a 400 error", err)
+	}
+}
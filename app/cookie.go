@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Cookies parses the cookie headers of the request into a map of name to
+// value. If a name is sent more than once, the first value wins.
+func (r *Req) Cookies() map[string]string {
+	cookies := make(map[string]string)
+	for _, header := range r.Headers.Values("cookie") {
+		for _, pair := range strings.Split(header, ";") {
+			name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if !ok || name == "" {
+				continue
+			}
+			if _, seen := cookies[name]; !seen {
+				cookies[name] = strings.Trim(value, "\"")
+			}
+		}
+	}
+	return cookies
+}
+
+// CookieOptions are the attributes of a cookie set with SetCookie. Zero
+// values leave the attribute out.
+type CookieOptions struct {
+	Path string
+	// MaxAge is in seconds. A negative MaxAge deletes the cookie.
+	MaxAge   int
+	HttpOnly bool
+	Secure   bool
+	// SameSite is one of Strict, Lax or None
+	SameSite string
+}
+
+// SetCookie adds a set-cookie header to the response. value must already be
+// made of valid cookie octets.
+func (r *Res) SetCookie(name, value string, opts CookieOptions) {
+	cookie := name + "=" + value
+	if opts.Path != "" {
+		cookie += "; Path=" + opts.Path
+	}
+	if opts.MaxAge > 0 {
+		cookie += fmt.Sprintf("; Max-Age=%d", opts.MaxAge)
+	} else if opts.MaxAge < 0 {
+		cookie += "; Max-Age=0"
+	}
+	if opts.HttpOnly {
+		cookie += "; HttpOnly"
+	}
+	if opts.Secure {
+		cookie += "; Secure"
+	}
+	if opts.SameSite != "" {
+		cookie += "; SameSite=" + opts.SameSite
+	}
+	r.cookies = append(r.cookies, cookie)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCookies(t *testing.T) {
+	req := newReq("GET", "/")
+	req.Headers.Add("Cookie", `session=abc123; theme="dark"; broken; =nameless`)
+	req.Headers.Add("Cookie", "session=second; lang=en")
+	got := req.Cookies()
+	want := map[string]string{"session": "abc123", "theme": "dark", "lang": "en"}
+	if len(got) != len(want) {
+		t.Errorf("cookies = %v, want %v", got, want)
+	}
+	for name, value := range want {
+		if got[name] != value {
+			t.Errorf("cookie %s = %q, want %q", name, got[name], value)
+		}
+	}
+}
+
+func TestSetCookie(t *testing.T) {
+	res := &Res{Status: 200}
+	res.SetCookie("session", "abc123", CookieOptions{Path: "/", MaxAge: 3600, HttpOnly: true, Secure: true, SameSite: "Lax"})
+	res.SetCookie("old", "", CookieOptions{MaxAge: -1})
+	got := res.String()
+	for _, line := range []string{
+		"\r\nSet-Cookie: session=abc123; Path=/; Max-Age=3600; HttpOnly; Secure; SameSite=Lax\r\n",
+		"\r\nSet-Cookie: old=; Max-Age=0\r\n",
+	} {
+		if !strings.Contains(got, line) {
+			t.Errorf("response lacks %q:\n%s", line, got)
+		}
+	}
+}
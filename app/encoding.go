@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// supportedEncodings lists the content-codings compress understands
+var supportedEncodings = []string{"gzip", "deflate"}
+
+// parseAcceptEncoding returns the q-value of every coding in an
+// accept-encoding header. Codings without a q parameter default to 1.
+func parseAcceptEncoding(acceptEncoding string) map[string]float64 {
+	codings := make(map[string]float64)
+	for _, entry := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(entry, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			k, v, _ := strings.Cut(param, "=")
+			if strings.EqualFold(strings.TrimSpace(k), "q") {
+				parsed, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+				if err != nil || parsed < 0 || parsed > 1 {
+					// treat a malformed q-value as not acceptable
+					parsed = 0
+				}
+				q = parsed
+			}
+		}
+		codings[coding] = q
+	}
+	return codings
+}
+
+// negotiateEncoding picks the supported codec with the highest q-value in an
+// accept-encoding header, or "" to send the body as-is. Ties go to the order
+// of supportedEncodings.
+func negotiateEncoding(acceptEncoding string) string {
+	codings := parseAcceptEncoding(acceptEncoding)
+	best, bestQ := "", 0.0
+	for _, supported := range supportedEncodings {
+		q, ok := codings[supported]
+		if !ok {
+			// * covers every coding not listed explicitly
+			q = codings["*"]
+		}
+		if q > bestQ {
+			best, bestQ = supported, q
+		}
+	}
+	return best
+}
+
+// acceptsGzip reports whether req's accept-encoding header allows gzip
+func acceptsGzip(req *Req) bool {
+	codings := parseAcceptEncoding(strings.Join(req.Headers.Values("accept-encoding"), ","))
+	q, ok := codings["gzip"]
+	if !ok {
+		q = codings["*"]
+	}
+	return q > 0
+}
+
+// compressResponses is middleware compressing response bodies with the codec
+// negotiated from the request's accept-encoding header. Streamed bodies are
+// sent as they are, since compressing them would mean reading them in to
+// learn the content-length, and so are empty ones, which would only grow.
+func compressResponses(next HandlerFunc) HandlerFunc {
+	return func(ctx context.Context, req *Req) *Res {
+		res := next(ctx, req)
+		if res.Stream != nil || len(res.Body) == 0 || res.Status == 204 || res.Status == 304 {
+			return res
+		}
+		// caches must tell clients apart by accept-encoding, even when this
+		// one gets the body as-is
+		addVary(res, "Accept-Encoding")
+		enc := negotiateEncoding(strings.Join(req.Headers.Values("accept-encoding"), ","))
+		if enc == "" {
+			return res
+		}
+		b, err := compress(enc, res.Body)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not compress to %s: %s\n", enc, err)
+			return res
+		}
+		// only advertise the encoding once the body has actually been compressed
+		res.Body = b
+		res.SetHeader("content-encoding", enc)
+		return res
+	}
+}
+
+// addVary lists header in the vary header of res, unless it's there already
+func addVary(res *Res, header string) {
+	vary := res.Headers["vary"]
+	for _, v := range strings.Split(vary, ",") {
+		if v = strings.TrimSpace(v); v == "*" || strings.EqualFold(v, header) {
+			return
+		}
+	}
+	if vary != "" {
+		vary += ", "
+	}
+	res.SetHeader("vary", vary+header)
+}
+
+func compress(enc string, data []byte) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	var w io.WriteCloser
+	switch enc {
+	case "gzip":
+		w = gzip.NewWriter(buf)
+	case "deflate":
+		// the "deflate" coding is the zlib format, not raw deflate
+		w = zlib.NewWriter(buf)
+	default:
+		return nil, fmt.Errorf("Unsupported encoding %q", enc)
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	// Close flushes the remaining data and writes the footer
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decompress undoes the content-coding enc of a request body, refusing to
+// inflate it past -max-body-bytes
+func decompress(enc string, data []byte) ([]byte, error) {
+	var r io.Reader
+	var err error
+	switch strings.ToLower(enc) {
+	case "", "identity":
+		return data, nil
+	case "gzip", "x-gzip":
+		r, err = gzip.NewReader(bytes.NewReader(data))
+	case "deflate":
+		r, err = zlib.NewReader(bytes.NewReader(data))
+	default:
+		return nil, &StatusError{415, fmt.Sprintf("Unsupported content-encoding %q", enc)}
+	}
+	if err != nil {
+		return nil, &StatusError{400, "Malformed " + enc + " body"}
+	}
+	body, err := io.ReadAll(io.LimitReader(r, int64(maxBodyBytes)+1))
+	if err != nil {
+		return nil, &StatusError{400, "Malformed " + enc + " body"}
+	}
+	if len(body) > maxBodyBytes {
+		return nil, errBodyTooLarge
+	}
+	return body, nil
+}
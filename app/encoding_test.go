@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEchoGzip(t *testing.T) {
+	addr := startServer(t)
+	res, body := do(t, addr, rawRequest("GET", "/echo/abc", "", "Accept-Encoding: gzip"))
+	if got := res.Header.Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("content-encoding = %q, want gzip", got)
+	}
+	zr, err := gzip.NewReader(strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plain) != "abc" {
+		t.Errorf("decompressed body = %q, want abc", plain)
+	}
+}
+
+func TestEchoIdentity(t *testing.T) {
+	addr := startServer(t)
+	res, body := do(t, addr, rawRequest("GET", "/echo/abc", ""))
+	if got := res.Header.Get("Content-Encoding"); got != "" {
+		t.Errorf("content-encoding = %q, want none", got)
+	}
+	if body != "abc" {
+		t.Errorf("body = %q, want abc", body)
+	}
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	for header, want := range map[string]string{
+		"":              "",
+		"deflate":       "deflate",
+		"gzip, deflate": "gzip",
+		"br":            "",
+	} {
+		if got := negotiateEncoding(header); got != want {
+			t.Errorf("negotiateEncoding(%q) = %q, want %q", header, got, want)
+		}
+	}
+}
+
+func TestEchoDeflate(t *testing.T) {
+	addr := startServer(t)
+	res, body := do(t, addr, rawRequest("GET", "/echo/abc", "", "Accept-Encoding: deflate"))
+	if got := res.Header.Get("Content-Encoding"); got != "deflate" {
+		t.Fatalf("content-encoding = %q, want deflate", got)
+	}
+	zr, err := zlib.NewReader(strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain, err := io.ReadAll(zr); err != nil || string(plain) != "abc" {
+		t.Errorf("decompressed body = %q (%v), want abc", plain, err)
+	}
+}
+
+func TestUnsupportedEncodingIsIdentity(t *testing.T) {
+	addr := startServer(t)
+	res, body := do(t, addr, rawRequest("GET", "/echo/abc", "", "Accept-Encoding: br"))
+	if got := res.Header.Get("Content-Encoding"); got != "" || body != "abc" {
+		t.Errorf("br: content-encoding = %q, body = %q, want none and abc", got, body)
+	}
+}
+
+func TestCompressedResponsesVary(t *testing.T) {
+	addr := startServer(t)
+	for _, ae := range []string{"gzip", "br", ""} {
+		res, _ := do(t, addr, rawRequest("GET", "/echo/abc", "", "Accept-Encoding: "+ae))
+		if got := res.Header.Get("Vary"); got != "Accept-Encoding" {
+			t.Errorf("accept-encoding %q: vary = %q, want Accept-Encoding", ae, got)
+		}
+	}
+}
+
+func TestEmptyBodiesAreNotCompressed(t *testing.T) {
+	addr := startServer(t)
+	for _, tc := range []struct{ method, target string }{{"GET", "/nope"}, {"PUT", "/echo/x"}} {
+		res, body := do(t, addr, rawRequest(tc.method, tc.target, "", "Accept-Encoding: gzip"))
+		if got := res.Header.Get("Content-Encoding"); got != "" || body != "" {
+			t.Errorf("%s %s: content-encoding = %q with %d bytes, want an empty identity body", tc.method, tc.target, got, len(body))
+		}
+	}
+}
+
+func TestNegotiateEncodingQValues(t *testing.T) {
+	for header, want := range map[string]string{
+		"gzip;q=0, deflate;q=1":     "deflate",
+		"gzip;q=0, deflate;q=0":     "",
+		"*;q=0.5, gzip;q=0.1":       "deflate",
+		"*;q=0":                     "",
+		"deflate;q=0.5, gzip":       "gzip",
+		"gzip;q=bogus, deflate":     "deflate",
+		"GZIP;Q=0.8, deflate;q=0.9": "deflate",
+	} {
+		if got := negotiateEncoding(header); got != want {
+			t.Errorf("negotiateEncoding(%q) = %q, want %q", header, got, want)
+		}
+	}
+}
+
+func TestCompressedContentLength(t *testing.T) {
+	addr := startServer(t)
+	plain := strings.Repeat("abc", 100)
+	for _, enc := range []string{"gzip", "deflate", "identity"} {
+		res, body := do(t, addr, rawRequest("GET", "/echo/"+plain, "", "Accept-Encoding: "+enc))
+		if res.ContentLength != int64(len(body)) {
+			t.Errorf("%s: content-length = %d for a %d byte body", enc, res.ContentLength, len(body))
+		}
+		var zr io.Reader = strings.NewReader(body)
+		var err error
+		switch enc {
+		case "gzip":
+			zr, err = gzip.NewReader(zr)
+		case "deflate":
+			zr, err = zlib.NewReader(zr)
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", enc, err)
+		}
+		if got, err := io.ReadAll(zr); err != nil || string(got) != plain {
+			t.Errorf("%s: decoded %d bytes (%v), want the %d echoed", enc, len(got), err, len(plain))
+		}
+		if enc != "identity" && len(body) >= len(plain) {
+			t.Errorf("%s: %d byte body isn't compressed", enc, len(body))
+		}
+	}
+}
+
+func TestGzipRequestBody(t *testing.T) {
+	dir := serveFiles(t)
+	addr := startServer(t)
+	var b bytes.Buffer
+	zw := gzip.NewWriter(&b)
+	io.WriteString(zw, "decompressed content")
+	zw.Close()
+	if res, _ := do(t, addr, rawRequest("POST", "/files/x", b.String(), "Content-Encoding: gzip")); res.StatusCode != 201 {
+		t.Fatalf("status = %d, want 201", res.StatusCode)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "x")); string(got) != "decompressed content" {
+		t.Errorf("stored %q, want the decompressed content", got)
+	}
+	for enc, want := range map[string]int{"gzip": 400, "br": 415} {
+		if res, _ := do(t, addr, rawRequest("POST", "/files/y", "not compressed", "Content-Encoding: "+enc)); res.StatusCode != want {
+			t.Errorf("%s body that isn't: status = %d, want %d", enc, res.StatusCode, want)
+		}
+	}
+}
+
+func TestDecompressLimit(t *testing.T) {
+	set(t, &maxBodyBytes, 1<<10)
+	var b bytes.Buffer
+	zw := gzip.NewWriter(&b)
+	zw.Write(make([]byte, 1<<20))
+	zw.Close()
+	// a small body that would inflate past the limit
+	if _, err := decompress("gzip", b.Bytes()); err != errBodyTooLarge {
+		t.Errorf("decompressing a gzip bomb = %v, want errBodyTooLarge", err)
+	}
+}
+
+func TestPrecompressedSidecar(t *testing.T) {
+	dir := serveFiles(t)
+	os.WriteFile(filepath.Join(dir, "app.js"), []byte("plain js"), 0644)
+	os.WriteFile(filepath.Join(dir, "app.js.gz"), []byte("pretend gzip"), 0644)
+	os.WriteFile(filepath.Join(dir, "lonely.js"), []byte("no sidecar"), 0644)
+	addr := startServer(t)
+	for _, tc := range []struct {
+		target, ae, body, enc, vary string
+	}{
+		{"/files/app.js", "gzip", "pretend gzip", "gzip", "Accept-Encoding"},
+		{"/files/app.js", "", "plain js", "", "Accept-Encoding"},
+		{"/files/lonely.js", "gzip", "no sidecar", "", ""},
+	} {
+		res, body := do(t, addr, rawRequest("GET", tc.target, "", "Accept-Encoding: "+tc.ae))
+		if body != tc.body || res.Header.Get("Content-Encoding") != tc.enc || res.Header.Get("Vary") != tc.vary {
+			t.Errorf("%s accepting %q: %q encoded %q varying %q, want %q encoded %q varying %q",
+				tc.target, tc.ae, body, res.Header.Get("Content-Encoding"), res.Header.Get("Vary"), tc.body, tc.enc, tc.vary)
+		}
+		if ctype := res.Header.Get("Content-Type"); !strings.HasPrefix(ctype, "text/javascript") {
+			t.Errorf("%s accepting %q: content-type = %q, want the original's", tc.target, tc.ae, ctype)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// logOutput is where access log lines are written
+var logOutput io.Writer = os.Stdout
+
+type accessLogEntry struct {
+	ID         string  `json:"id"`
+	Remote     string  `json:"remote"`
+	Method     string  `json:"method"`
+	Path       string  `json:"path"`
+	Status     uint    `json:"status"`
+	Bytes      int     `json:"bytes"`
+	DurationMs float64 `json:"duration_ms"`
+}
+
+// logRequests is middleware writing an access log line for every request
+func logRequests(next HandlerFunc) HandlerFunc {
+	return func(ctx context.Context, req *Req) *Res {
+		start := time.Now()
+		res := next(ctx, req)
+		remote := req.RemoteAddr
+		if trustProxy {
+			// the peer is the proxy, which says little about who made the request
+			remote = req.ClientIP
+		}
+		logRequest(req, res, remote, time.Since(start))
+		return res
+	}
+}
+
+// logRequest writes a single access log line for a served request, in the
+// format selected by -log-format
+func logRequest(req *Req, res *Res, remote string, dur time.Duration) {
+	entry := accessLogEntry{
+		ID:         req.ID,
+		Remote:     remote,
+		Method:     req.Method,
+		Path:       req.RawPath,
+		Status:     res.Status,
+		Bytes:      len(res.Body),
+		DurationMs: float64(dur.Microseconds()) / 1000,
+	}
+	if res.Stream != nil && res.StreamLen >= 0 {
+		entry.Bytes = int(res.StreamLen)
+	}
+	if req.Method == "HEAD" {
+		entry.Bytes = 0
+	}
+
+	if logFormat == "json" {
+		b, err := json.Marshal(entry)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Could not encode access log entry:", err)
+			return
+		}
+		fmt.Fprintln(logOutput, string(b))
+		return
+	}
+	fmt.Fprintf(logOutput, "id=%s remote=%s method=%s path=%q status=%d bytes=%d duration=%s\n",
+		entry.ID, entry.Remote, entry.Method, entry.Path, entry.Status, entry.Bytes, dur)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lockedBuffer is a bytes.Buffer safe to write from the server's goroutines
+// while the test reads it
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestLogRequestText(t *testing.T) {
+	var buf bytes.Buffer
+	set(t, &logOutput, io.Writer(&buf))
+	req := &Req{Method: "GET", RawPath: "/echo/a b", ID: "abc"}
+	logRequest(req, &Res{Status: 200, Body: []byte("a b")}, "1.2.3.4:5", 1500*time.Microsecond)
+	want := `id=abc remote=1.2.3.4:5 method=GET path="/echo/a b" status=200 bytes=3 duration=1.5ms` + "\n"
+	if buf.String() != want {
+		t.Errorf("logged %q, want %q", buf.String(), want)
+	}
+}
+
+func TestLogRequestJSON(t *testing.T) {
+	var buf bytes.Buffer
+	set(t, &logOutput, io.Writer(&buf))
+	set(t, &logFormat, "json")
+	req := &Req{Method: "POST", RawPath: "/files/x", ID: "abc"}
+	logRequest(req, &Res{Status: 201}, "1.2.3.4:5", 2*time.Millisecond)
+	var entry accessLogEntry
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("logged %q: %v", buf.String(), err)
+	}
+	want := accessLogEntry{ID: "abc", Remote: "1.2.3.4:5", Method: "POST", Path: "/files/x", Status: 201, DurationMs: 2}
+	if entry != want {
+		t.Errorf("logged %+v, want %+v", entry, want)
+	}
+}
+
+func TestAccessLogIsJSONLines(t *testing.T) {
+	set(t, &logFormat, "json")
+	var buf lockedBuffer
+	set(t, &logOutput, io.Writer(&buf))
+	addr := startServer(t)
+	do(t, addr, rawRequest("GET", "/echo/one", ""))
+	do(t, addr, rawRequest("GET", "/nope", ""))
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("logged %d lines, want 2:\n%s", len(lines), buf.String())
+	}
+	for i, want := range []uint{200, 404} {
+		var entry accessLogEntry
+		if err := json.Unmarshal([]byte(lines[i]), &entry); err != nil || entry.Status != want {
+			t.Errorf("line %d = %s (%v), want a JSON entry with status %d", i, lines[i], err, want)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+)
+
+// counters exposed at /metrics
+var requestsTotal atomic.Int64
+var bytesServed atomic.Int64
+
+// idleConns counts keep-alive connections waiting for their next request
+var idleConns atomic.Int64
+
+// responsesByClass is indexed by the first digit of the status code
+var responsesByClass [6]atomic.Int64
+
+// recordResponse counts a response of n bytes written to a client
+func recordResponse(status uint, n int) {
+	requestsTotal.Add(1)
+	bytesServed.Add(int64(n))
+	if class := status / 100; class >= 1 && class <= 5 {
+		responsesByClass[class].Add(1)
+	}
+}
+
+// handleMetrics renders the counters in the Prometheus text exposition format
+func handleMetrics(ctx context.Context, req *Req) *Res {
+	body := "# HELP http_requests_total Total number of requests served.\n"
+	body += "# TYPE http_requests_total counter\n"
+	body += fmt.Sprintf("http_requests_total %d\n", requestsTotal.Load())
+	body += "# HELP http_responses_total Responses sent, by status class.\n"
+	body += "# TYPE http_responses_total counter\n"
+	for class := 1; class <= 5; class++ {
+		body += fmt.Sprintf("http_responses_total{class=\"%dxx\"} %d\n", class, responsesByClass[class].Load())
+	}
+	body += "# HELP http_response_bytes_total Total bytes written in responses.\n"
+	body += "# TYPE http_response_bytes_total counter\n"
+	body += fmt.Sprintf("http_response_bytes_total %d\n", bytesServed.Load())
+	body += "# HELP http_active_connections Connections currently open.\n"
+	body += "# TYPE http_active_connections gauge\n"
+	body += fmt.Sprintf("http_active_connections %d\n", activeConns.Load())
+	body += "# HELP http_idle_connections Keep-alive connections waiting for a request.\n"
+	body += "# TYPE http_idle_connections gauge\n"
+	body += fmt.Sprintf("http_idle_connections %d\n", idleConns.Load())
+	return &Res{
+		Status: 200,
+		CType:  "text/plain; version=0.0.4",
+		Body:   []byte(body),
+	}
+}
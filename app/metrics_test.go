@@ -0,0 +1,54 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// scrape fetches /metrics from addr, returning each sample's value by name
+func scrape(t *testing.T, addr string) map[string]float64 {
+	t.Helper()
+	res, body := do(t, addr, rawRequest("GET", "/metrics", ""))
+	if res.StatusCode != 200 {
+		t.Fatalf("/metrics = %d", res.StatusCode)
+	}
+	samples := make(map[string]float64)
+	for _, line := range strings.Split(strings.TrimSpace(body), "\n") {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(line, " ")
+		v, err := strconv.ParseFloat(value, 64)
+		if !ok || err != nil {
+			t.Fatalf("malformed sample %q", line)
+		}
+		samples[name] = v
+	}
+	return samples
+}
+
+func TestMetrics(t *testing.T) {
+	addr := startServer(t)
+	before := scrape(t, addr)
+	for _, name := range []string{
+		"http_requests_total",
+		`http_responses_total{class="2xx"}`,
+		`http_responses_total{class="4xx"}`,
+		"http_response_bytes_total",
+		"http_active_connections",
+		"http_idle_connections",
+	} {
+		if _, ok := before[name]; !ok {
+			t.Errorf("/metrics lacks %s", name)
+		}
+	}
+	do(t, addr, rawRequest("GET", "/nope", ""))
+	after := scrape(t, addr)
+	if after["http_requests_total"] <= before["http_requests_total"] {
+		t.Errorf("http_requests_total went from %v to %v, want it bumped", before["http_requests_total"], after["http_requests_total"])
+	}
+	if after[`http_responses_total{class="4xx"}`] <= before[`http_responses_total{class="4xx"}`] {
+		t.Error("404 didn't bump the 4xx count")
+	}
+}
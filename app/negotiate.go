@@ -0,0 +1,30 @@
+package main
+
+import "strings"
+
+// negotiateMediaType picks the offered media type the accept header rates
+// highest, or "" if it accepts none of them. A missing header accepts
+// anything, giving the first offer. Ties go to the order of offers.
+func negotiateMediaType(accept string, offers []string) string {
+	if strings.TrimSpace(accept) == "" {
+		return offers[0]
+	}
+	// media ranges carry q-values the same way content-codings do
+	ranges := parseAcceptEncoding(accept)
+	best, bestQ := "", 0.0
+	for _, offer := range offers {
+		typ, _, _ := strings.Cut(offer, "/")
+		// the most specific range that matches decides the q-value
+		q, ok := ranges[offer]
+		if !ok {
+			q, ok = ranges[typ+"/*"]
+		}
+		if !ok {
+			q = ranges["*/*"]
+		}
+		if q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
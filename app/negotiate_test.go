@@ -0,0 +1,22 @@
+package main
+
+import "testing"
+
+func TestNegotiateMediaType(t *testing.T) {
+	offers := []string{"text/plain", "application/json"}
+	for accept, want := range map[string]string{
+		"":                                     "text/plain",
+		"*/*":                                  "text/plain",
+		"application/json":                     "application/json",
+		"text/plain":                           "text/plain",
+		"text/*;q=0.5, application/json":       "application/json",
+		"application/*":                        "application/json",
+		"application/json;q=0, */*;q=0.1":      "text/plain",
+		"image/png":                            "",
+		"text/plain;q=0, application/json;q=0": "",
+	} {
+		if got := negotiateMediaType(accept, offers); got != want {
+			t.Errorf("negotiateMediaType(%q) = %q, want %q", accept, got, want)
+		}
+	}
+}
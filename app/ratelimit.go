@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// bucket holds the tokens left to a client, as of last
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter is a token bucket per client IP, refilled at rate tokens a
+// second up to burst
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(max(burst, 1)),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// take spends one of ip's tokens. If there are none left, it reports false
+// and how long until the next one is available.
+func (l *rateLimiter) take(ip string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	t := now()
+	b, ok := l.buckets[ip]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: t}
+		l.buckets[ip] = b
+	}
+	b.tokens = min(l.burst, b.tokens+t.Sub(b.last).Seconds()*l.rate)
+	b.last = t
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// cleanup forgets the buckets that have refilled completely, as a new bucket
+// would be the same
+func (l *rateLimiter) cleanup() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	t := now()
+	for ip, b := range l.buckets {
+		if b.tokens+t.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, ip)
+		}
+	}
+}
+
+// cleanupEvery calls cleanup at every interval, forever
+func (l *rateLimiter) cleanupEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		l.cleanup()
+	}
+}
+
+// limitRequests is middleware answering 429 to clients that have run out of
+// tokens
+func (l *rateLimiter) limitRequests(next HandlerFunc) HandlerFunc {
+	return func(ctx context.Context, req *Req) *Res {
+		if ok, wait := l.take(req.ClientIP); !ok {
+			return TooManyRequests(int(math.Ceil(wait.Seconds())))
+		}
+		return next(ctx, req)
+	}
+}
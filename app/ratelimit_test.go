@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeClock makes now return the time it holds, for the test's duration
+func fakeClock(t *testing.T) *time.Time {
+	clock := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	set(t, &now, func() time.Time { return clock })
+	return &clock
+}
+
+func TestRateLimiter(t *testing.T) {
+	clock := fakeClock(t)
+	l := newRateLimiter(1, 2)
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.take("1.2.3.4"); !ok {
+			t.Fatalf("request %d within the burst was refused", i)
+		}
+	}
+	if ok, wait := l.take("1.2.3.4"); ok || wait != time.Second {
+		t.Errorf("request over the burst = %t waiting %s, want refused for 1s", ok, wait)
+	}
+	// other clients have their own bucket
+	if ok, _ := l.take("5.6.7.8"); !ok {
+		t.Error("another client was refused")
+	}
+	*clock = clock.Add(time.Second)
+	if ok, _ := l.take("1.2.3.4"); !ok {
+		t.Error("request after a token refilled was refused")
+	}
+
+	*clock = clock.Add(time.Minute)
+	l.cleanup()
+	if len(l.buckets) != 0 {
+		t.Errorf("%d buckets left after they all refilled, want none", len(l.buckets))
+	}
+}
+
+func TestLimitRequests(t *testing.T) {
+	fakeClock(t)
+	h := newRateLimiter(0.5, 1).limitRequests(text("ok"))
+	req := newReq("GET", "/")
+	req.ClientIP = "1.2.3.4"
+	if res := h(context.Background(), req); res.Status != 200 {
+		t.Fatalf("first request = %d, want 200", res.Status)
+	}
+	res := h(context.Background(), req)
+	if res.Status != 429 || res.Headers["retry-after"] != "2" {
+		t.Errorf("second request = %d with retry-after %q, want 429 and 2", res.Status, res.Headers["retry-after"])
+	}
+}
+
+func TestRateLimitFlags(t *testing.T) {
+	fakeClock(t)
+	set(t, &rateLimit, 1)
+	set(t, &rateBurst, 3)
+	addr := startServer(t)
+	var statuses []int
+	for i := 0; i < 5; i++ {
+		res, _ := do(t, addr, rawRequest("GET", "/echo/x", ""))
+		statuses = append(statuses, res.StatusCode)
+	}
+	if fmt.Sprint(statuses) != "[200 200 200 429 429]" {
+		t.Errorf("statuses = %v, want three 200s then 429s", statuses)
+	}
+}
+
+func TestTooManyRequests(t *testing.T) {
+	got := TooManyRequests(7).String()
+	if !strings.HasPrefix(got, "HTTP/1.1 429 Too Many Requests\r\n") || !strings.Contains(got, "\r\nRetry-After: 7\r\n") {
+		t.Errorf("TooManyRequests(7) renders as:\n%s", got)
+	}
+}
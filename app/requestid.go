@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+)
+
+// maxRequestIDLen bounds the client-supplied request ids that are honored
+const maxRequestIDLen = 128
+
+// assignRequestIDs is middleware giving every request an id, taken from its
+// x-request-id header if it has a usable one, and echoing it in the response
+func assignRequestIDs(next HandlerFunc) HandlerFunc {
+	return func(ctx context.Context, req *Req) *Res {
+		req.ID = req.Headers.Get("x-request-id")
+		if !validRequestID(req.ID) {
+			req.ID = newRequestID()
+		}
+		res := next(ctx, req)
+		res.SetHeader("x-request-id", req.ID)
+		return res
+	}
+}
+
+// validRequestID reports whether id is short and only holds printable ASCII,
+// so it can't break the log or response headers
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	return !strings.ContainsFunc(id, func(r rune) bool {
+		return r <= ' ' || r > '~'
+	})
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
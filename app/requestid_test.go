@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestRequestID(t *testing.T) {
+	var buf lockedBuffer
+	set(t, &logFormat, "json")
+	set(t, &logOutput, io.Writer(&buf))
+	addr := startServer(t)
+
+	res, _ := do(t, addr, rawRequest("GET", "/echo/x", ""))
+	generated := res.Header.Get("X-Request-ID")
+	if len(generated) != 32 {
+		t.Errorf("generated id = %q, want 32 hex digits", generated)
+	}
+	if res, _ := do(t, addr, rawRequest("GET", "/echo/x", "", "X-Request-ID: trace-123")); res.Header.Get("X-Request-ID") != "trace-123" {
+		t.Errorf("id = %q, want the client's trace-123", res.Header.Get("X-Request-ID"))
+	}
+	// ids that would break the log or headers are replaced
+	long := strings.Repeat("a", maxRequestIDLen+1)
+	for _, bad := range []string{"has space", long} {
+		res, _ := do(t, addr, rawRequest("GET", "/echo/x", "", "X-Request-ID: "+bad))
+		if got := res.Header.Get("X-Request-ID"); got == bad || len(got) != 32 {
+			t.Errorf("client id %.20q was answered with %q, want a generated one", bad, got)
+		}
+	}
+
+	// the access log carries the same ids
+	dec := json.NewDecoder(strings.NewReader(buf.String()))
+	var ids []string
+	for dec.More() {
+		var entry accessLogEntry
+		if err := dec.Decode(&entry); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, entry.ID)
+	}
+	if len(ids) != 4 || ids[0] != generated || ids[1] != "trace-123" {
+		t.Errorf("logged ids %q, want %s then trace-123 first", ids, generated)
+	}
+}
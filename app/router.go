@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"strings"
+)
+
+// HandlerFunc handles a request. ctx is cancelled if the client goes away
+// before the response is written.
+type HandlerFunc func(ctx context.Context, req *Req) *Res
+
+// Middleware wraps a HandlerFunc, to run code around it or answer in its place
+type Middleware func(HandlerFunc) HandlerFunc
+
+type route struct {
+	method  string
+	pattern string
+	// prefix and wildcard are set for patterns ending in a {name...} segment
+	prefix   string
+	wildcard string
+	fn       HandlerFunc
+}
+
+// match reports whether p matches the route's pattern, returning the
+// captured wildcard (if any)
+func (r *route) match(p string) (map[string]string, bool) {
+	if r.wildcard == "" {
+		return nil, p == r.pattern
+	}
+	rest, ok := strings.CutPrefix(p, r.prefix)
+	if !ok {
+		return nil, false
+	}
+	return map[string]string{r.wildcard: rest}, true
+}
+
+type Router struct {
+	routes     []route
+	middleware []Middleware
+	// NotFound, if set, answers requests matching no route
+	NotFound HandlerFunc
+	// RedirectTrailingSlash redirects requests matching no route to the same
+	// path with the trailing slash added or removed, if that matches one
+	RedirectTrailingSlash bool
+	// DisabledMethods are answered with 405 on every path, and left out of
+	// allow headers. Disabling GET disables HEAD, which GET routes serve.
+	DisabledMethods []string
+	// AlwaysAllowed are methods that middleware answers on every path, for
+	// allow headers to list along with those of the routes
+	AlwaysAllowed []string
+}
+
+func NewRouter() *Router {
+	return &Router{}
+}
+
+// Handle registers fn for requests with the given method whose path matches
+// pattern. A pattern is either an exact path, or a path ending in a wildcard
+// segment like /echo/{rest...}, which matches everything after the prefix.
+func (rt *Router) Handle(method, pattern string, fn HandlerFunc) {
+	r := route{method: method, pattern: pattern, fn: fn}
+	if i := strings.LastIndex(pattern, "/{"); i >= 0 && strings.HasSuffix(pattern, "...}") {
+		r.prefix = pattern[:i+1]
+		r.wildcard = pattern[i+2 : len(pattern)-len("...}")]
+	}
+	rt.routes = append(rt.routes, r)
+}
+
+// Use adds mw around every request the router serves, including those that
+// don't match a route. Middleware added first runs outermost.
+func (rt *Router) Use(mw Middleware) {
+	rt.middleware = append(rt.middleware, mw)
+}
+
+func (rt *Router) hasRoute(method, p string) bool {
+	for _, r := range rt.routes {
+		if _, ok := r.match(p); ok && r.method == method {
+			return true
+		}
+	}
+	return false
+}
+
+// methods lists every method routes are registered for, as an allow header
+// would
+func (rt *Router) methods() []string {
+	var methods []string
+	for _, r := range rt.routes {
+		methods = rt.allow(methods, r.method)
+		if r.method == "GET" {
+			methods = rt.allow(methods, "HEAD")
+		}
+	}
+	for _, m := range rt.AlwaysAllowed {
+		methods = rt.allow(methods, m)
+	}
+	return rt.allow(methods, "OPTIONS")
+}
+
+// allow adds m to methods unless it is already there or disabled
+func (rt *Router) allow(methods []string, m string) []string {
+	if slices.Contains(methods, m) || rt.disabled(m) {
+		return methods
+	}
+	return append(methods, m)
+}
+
+// disabled reports whether m is one of DisabledMethods, or HEAD with GET
+func (rt *Router) disabled(m string) bool {
+	if m == "HEAD" && slices.Contains(rt.DisabledMethods, "GET") {
+		return true
+	}
+	return slices.Contains(rt.DisabledMethods, m)
+}
+
+// matchesAny reports whether p matches a route for any method
+func (rt *Router) matchesAny(p string) bool {
+	for _, r := range rt.routes {
+		if _, ok := r.match(p); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// toggleSlash adds a trailing slash to p, or removes the one it has
+func toggleSlash(p string) string {
+	if trimmed, ok := strings.CutSuffix(p, "/"); ok {
+		return trimmed
+	}
+	return p + "/"
+}
+
+// ServeReq dispatches req to the first matching route, in registration order,
+// through the router's middleware
+func (rt *Router) ServeReq(ctx context.Context, req *Req) *Res {
+	h := rt.dispatch
+	for i := len(rt.middleware) - 1; i >= 0; i-- {
+		h = rt.middleware[i](h)
+	}
+	return h(ctx, req)
+}
+
+func (rt *Router) dispatch(ctx context.Context, req *Req) *Res {
+	disabled := rt.disabled(req.Method)
+	if req.Path == "*" && !disabled {
+		// OPTIONS * asks about the server as a whole
+		return handleOptions(req, rt.methods())
+	}
+	// HEAD is served by the GET handler unless it has its own route
+	headAsGet := req.Method == "HEAD" && !rt.hasRoute("HEAD", req.Path)
+	// methods the path is registered for, in case none match req.Method
+	var allowed []string
+	for _, r := range rt.routes {
+		params, ok := r.match(req.Path)
+		if !ok {
+			continue
+		}
+		if disabled || (r.method != req.Method && !(headAsGet && r.method == "GET")) {
+			allowed = rt.allow(allowed, r.method)
+			if r.method == "GET" {
+				allowed = rt.allow(allowed, "HEAD")
+			}
+			continue
+		}
+		req.Params = params
+		return r.fn(ctx, req)
+	}
+	if len(allowed) > 0 || disabled {
+		for _, m := range rt.AlwaysAllowed {
+			allowed = rt.allow(allowed, m)
+		}
+		// OPTIONS is answered for every path unless it has its own route
+		allowed = rt.allow(allowed, "OPTIONS")
+		if req.Method == "OPTIONS" && !disabled {
+			return handleOptions(req, allowed)
+		}
+		res := &Res{Status: 405}
+		res.SetHeader("allow", strings.Join(allowed, ", "))
+		return res
+	}
+	if rt.RedirectTrailingSlash && req.Path != "/" && rt.matchesAny(toggleSlash(req.Path)) {
+		location := toggleSlash(req.RawPath)
+		if req.RawQuery != "" {
+			location += "?" + req.RawQuery
+		}
+		return Redirect(301, location)
+	}
+	if rt.NotFound != nil {
+		return rt.NotFound(ctx, req)
+	}
+	return &Res{Status: 404}
+}
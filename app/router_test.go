@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+// newReq returns a request for the router tests, as parseRequest would
+func newReq(method, path string) *Req {
+	return &Req{Method: method, Proto: "HTTP/1.1", Path: path, RawPath: path, Headers: Header{}}
+}
+
+// text returns a handler answering 200 with body
+func text(body string) HandlerFunc {
+	return func(ctx context.Context, req *Req) *Res {
+		return &Res{Status: 200, Body: []byte(body)}
+	}
+}
+
+func TestRouterDispatch(t *testing.T) {
+	rt := NewRouter()
+	rt.Handle("GET", "/hello", text("hello"))
+	rt.Handle("POST", "/hello", text("posted"))
+	var rest string
+	rt.Handle("GET", "/greet/{who...}", func(ctx context.Context, req *Req) *Res {
+		rest = req.Params["who"]
+		return &Res{Status: 200}
+	})
+
+	if res := rt.ServeReq(context.Background(), newReq("GET", "/hello")); string(res.Body) != "hello" {
+		t.Errorf("GET /hello = %q, want hello", res.Body)
+	}
+	if res := rt.ServeReq(context.Background(), newReq("POST", "/hello")); string(res.Body) != "posted" {
+		t.Errorf("POST /hello = %q, want posted", res.Body)
+	}
+	if res := rt.ServeReq(context.Background(), newReq("GET", "/greet/a/b")); res.Status != 200 || rest != "a/b" {
+		t.Errorf("GET /greet/a/b = %d capturing %q, want 200 capturing a/b", res.Status, rest)
+	}
+	if res := rt.ServeReq(context.Background(), newReq("GET", "/nope")); res.Status != 404 {
+		t.Errorf("GET /nope = %d, want 404", res.Status)
+	}
+}
+
+func TestMiddlewareOrder(t *testing.T) {
+	var order []string
+	trace := func(name string) Middleware {
+		return func(next HandlerFunc) HandlerFunc {
+			return func(ctx context.Context, req *Req) *Res {
+				order = append(order, name+" in")
+				res := next(ctx, req)
+				order = append(order, name+" out")
+				return res
+			}
+		}
+	}
+	rt := NewRouter()
+	rt.Handle("GET", "/hello", text("hello"))
+	rt.Use(trace("outer"))
+	rt.Use(trace("inner"))
+	rt.Use(func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, req *Req) *Res {
+			if req.Headers.Get("authorization") == "" {
+				return Unauthorized("test")
+			}
+			return next(ctx, req)
+		}
+	})
+
+	if res := rt.ServeReq(context.Background(), newReq("GET", "/hello")); res.Status != 401 {
+		t.Errorf("status without credentials = %d, want 401", res.Status)
+	}
+	want := []string{"outer in", "inner in", "inner out", "outer out"}
+	if strings.Join(order, ", ") != strings.Join(want, ", ") {
+		t.Errorf("middleware ran as %q, want %q", order, want)
+	}
+
+	req := newReq("GET", "/hello")
+	req.Headers.Add("Authorization", "x")
+	if res := rt.ServeReq(context.Background(), req); string(res.Body) != "hello" {
+		t.Errorf("body with credentials = %q, want hello", res.Body)
+	}
+}
+
+func TestRedirectTrailingSlash(t *testing.T) {
+	rt := NewRouter()
+	rt.RedirectTrailingSlash = true
+	rt.Handle("GET", "/dir/", text("dir"))
+	rt.Handle("GET", "/page", text("page"))
+	for path, want := range map[string]string{"/dir": "/dir/", "/page/": "/page"} {
+		res := rt.ServeReq(context.Background(), newReq("GET", path))
+		if res.Status != 301 || res.Headers["location"] != want {
+			t.Errorf("GET %s = %d to %q, want 301 to %s", path, res.Status, res.Headers["location"], want)
+		}
+	}
+	req := newReq("GET", "/dir")
+	req.RawQuery = "a=1"
+	if res := rt.ServeReq(context.Background(), req); res.Headers["location"] != "/dir/?a=1" {
+		t.Errorf("redirect of /dir?a=1 goes to %q, want /dir/?a=1", res.Headers["location"])
+	}
+	if res := rt.ServeReq(context.Background(), newReq("GET", "/other")); res.Status != 404 {
+		t.Errorf("GET /other = %d, want 404", res.Status)
+	}
+
+	rt.RedirectTrailingSlash = false
+	if res := rt.ServeReq(context.Background(), newReq("GET", "/dir")); res.Status != 404 {
+		t.Errorf("GET /dir without redirects = %d, want 404", res.Status)
+	}
+}
@@ -1,30 +1,274 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
-	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
 	"errors"
 	"flag"
 	"fmt"
+	"html"
+	"io"
 	"io/fs"
+	"maps"
+	"mime"
 	"net"
+	"net/textproto"
+	"net/url"
 	"os"
+	"os/signal"
 	"path"
+	"path/filepath"
+	"runtime/debug"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
+// version is advertised in the server header
+const version = "0.1.0"
+
 var directory string
+var maxBodyBytes int
+var maxHeaderBytes int
+var host string
+var port int
+var shutdownTimeout time.Duration
+var readTimeout time.Duration
+var idleTimeout time.Duration
+var writeTimeout time.Duration
+var autoindex bool
+var noServerHeader bool
+var logFormat string
+var maxConns int
+var corsOrigin string
+var tlsCert string
+var tlsKey string
+var auth string
+var defaultCharset string
+var notFoundFile string
+var indexFile string
+var unixSocket string
+var rateLimit float64
+var rateBurst int
+var trustProxy bool
+var allowMethodOverride bool
+var allowTrace bool
+var cacheControl string
+var listingCacheControl string
+
+// mountFlag collects repeated -mount prefix=path flags into a map of URL
+// prefix to filesystem root
+type mountFlag map[string]string
+
+func (m mountFlag) String() string {
+	mounts := make([]string, 0, len(m))
+	for prefix, root := range m {
+		mounts = append(mounts, prefix+"="+root)
+	}
+	return strings.Join(mounts, ",")
+}
+
+func (m mountFlag) Set(v string) error {
+	prefix, root, ok := strings.Cut(v, "=")
+	if !ok || prefix == "" || root == "" {
+		return errors.New("must be of the form prefix=path")
+	}
+	// prefixes always match whole path segments
+	if !strings.HasPrefix(prefix, "/") {
+		prefix = "/" + prefix
+	}
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	m[prefix] = root
+	return nil
+}
+
+var mounts = mountFlag{}
+
+// vhostFlag collects repeated -vhost host=path flags into a map of lowercase
+// hostname to the directory served as /files/ for it
+type vhostFlag map[string]string
+
+func (v vhostFlag) String() string {
+	vhosts := make([]string, 0, len(v))
+	for host, dir := range v {
+		vhosts = append(vhosts, host+"="+dir)
+	}
+	return strings.Join(vhosts, ",")
+}
+
+func (v vhostFlag) Set(s string) error {
+	host, dir, ok := strings.Cut(s, "=")
+	if !ok || host == "" || dir == "" {
+		return errors.New("must be of the form host=path")
+	}
+	v[strings.ToLower(host)] = dir
+	return nil
+}
+
+var vhosts = vhostFlag{}
+
+// headerFlag collects repeated -header "Name: Value" flags into a map of
+// lowercase name to value
+type headerFlag map[string]string
+
+func (h headerFlag) String() string {
+	headers := make([]string, 0, len(h))
+	for k, v := range h {
+		headers = append(headers, k+": "+v)
+	}
+	return strings.Join(headers, ",")
+}
+
+func (h headerFlag) Set(v string) error {
+	k, v, ok := strings.Cut(v, ":")
+	k = strings.ToLower(strings.TrimSpace(k))
+	if !ok || k == "" {
+		return errors.New("must be of the form \"Name: Value\"")
+	}
+	// these describe the framing of each response, which only the server knows
+	if k == "content-length" || k == "transfer-encoding" || k == "connection" || k == "date" {
+		return fmt.Errorf("%s can't be set for every response", k)
+	}
+	h[k] = strings.TrimSpace(v)
+	return nil
+}
+
+// extraHeaders are added to every response that doesn't set them itself
+var extraHeaders = headerFlag{}
+
+// listenFlag collects repeated -listen flags, each an address to accept
+// connections on
+type listenFlag []string
+
+func (l *listenFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listenFlag) Set(addr string) error {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return err
+	}
+	*l = append(*l, addr)
+	return nil
+}
+
+var listenAddrs listenFlag
+
+// methodsFlag collects repeated -disable-method flags as uppercase methods
+type methodsFlag []string
+
+func (m *methodsFlag) String() string {
+	return strings.Join(*m, ",")
+}
+
+func (m *methodsFlag) Set(method string) error {
+	method = strings.ToUpper(method)
+	if !slices.Contains(knownMethods, method) {
+		return fmt.Errorf("unknown method %q", method)
+	}
+	*m = append(*m, method)
+	return nil
+}
+
+var disabledMethods methodsFlag
+
+// shuttingDown is set once a shutdown signal is received, so that
+// persistent connections are closed after their current request
+var shuttingDown atomic.Bool
+
+// startTime and activeConns are reported by /health
+var startTime = time.Now()
+var activeConns atomic.Int64
 
 func init() {
-	flag.StringVar(&directory, "directory", "", "Directory where files are located")
-	flag.Parse()
+	flag.StringVar(&directory, "directory", "", "Directory where files are located, shorthand for -mount /files/=<directory>")
+	flag.Var(extraHeaders, "header", "Header added to every response, as \"Name: Value\" (repeatable)")
+	flag.Var(vhosts, "vhost", "Serve /files/ and -index from a directory for one hostname, as host=path (repeatable)")
+	flag.Var(mounts, "mount", "Serve files under a URL prefix from a directory, as prefix=path (repeatable)")
+	flag.StringVar(&cacheControl, "cache-control", "", "Cache-control header sent with files, such as max-age=3600 (default none)")
+	flag.StringVar(&listingCacheControl, "listing-cache-control", "no-cache", "Cache-control header sent with -autoindex listings, empty for none")
+	flag.BoolVar(&autoindex, "autoindex", false, "List the contents of directories in mounts")
+	flag.BoolVar(&noServerHeader, "no-server-header", false, "Don't send a server header identifying the implementation")
+	flag.Var(&disabledMethods, "disable-method", "Method to answer with 405 on every path, such as DELETE (repeatable)")
+	flag.BoolVar(&allowTrace, "allow-trace", false, "Answer TRACE requests by echoing the request back")
+	flag.BoolVar(&allowMethodOverride, "allow-method-override", false, "Let POST requests be routed as the PUT, PATCH or DELETE named in x-http-method-override")
+	flag.BoolVar(&trustProxy, "trust-proxy", false, "Take the client IP from x-forwarded-for or forwarded headers set by a reverse proxy")
+	flag.StringVar(&corsOrigin, "cors-origin", "", "Origin allowed to make cross-origin requests, or * for any (default disabled)")
+	flag.StringVar(&defaultCharset, "default-charset", "utf-8", "Charset added to text/* content types that don't name one, empty to disable")
+	flag.StringVar(&logFormat, "log-format", "text", "Access log format, either text or json")
+	flag.StringVar(&tlsCert, "tls-cert", "", "TLS certificate file, serves HTTPS together with -tls-key")
+	flag.StringVar(&tlsKey, "tls-key", "", "TLS private key file")
+	flag.StringVar(&auth, "auth", "", "Require basic auth credentials, as user:pass, for file routes (default disabled)")
+	flag.StringVar(&indexFile, "index", "", "File in -directory served for requests to /, such as index.html")
+	flag.StringVar(&notFoundFile, "404-file", "", "HTML file served as the body of 404s for paths matching no route")
+	flag.StringVar(&host, "host", "0.0.0.0", "Host to listen on")
+	flag.IntVar(&port, "port", 4221, "Port to listen on")
+	flag.StringVar(&unixSocket, "unix", "", "Unix socket path to listen on, in place of -host and -port unless -listen is also given")
+	flag.Var(&listenAddrs, "listen", "Address to listen on, such as [::]:4221, in place of -host and -port (repeatable)")
+	flag.Float64Var(&rateLimit, "rate-limit", 0, "Requests per second allowed from each client IP, 0 for no limit")
+	flag.IntVar(&rateBurst, "rate-burst", 10, "Requests a client IP may make at once before -rate-limit applies")
+	flag.IntVar(&maxConns, "max-conns", 0, "Maximum number of connections served at once, 0 for no limit")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 10*time.Second, "How long to wait for active connections on shutdown")
+	flag.DurationVar(&readTimeout, "read-timeout", 10*time.Second, "Maximum time to wait for a request to be read")
+	flag.DurationVar(&idleTimeout, "idle-timeout", 60*time.Second, "How long to keep an idle keep-alive connection open")
+	flag.DurationVar(&writeTimeout, "write-timeout", 10*time.Second, "Maximum time to spend writing a response")
+	flag.IntVar(&maxBodyBytes, "max-body-bytes", 10<<20, "Maximum size of a request body in bytes")
+	flag.IntVar(&maxHeaderBytes, "max-header-bytes", 8<<10, "Maximum size of the request line and headers in bytes")
 }
 
 type Req struct {
 	Method  string
-	Path    string
-	Headers map[string]string
+	Proto   string // HTTP/1.0 or HTTP/1.1
+	Path    string // percent-decoded
+	RawPath string // exactly as sent by the client
+	Query   map[string]string
+	Headers Header
 	Body    []byte
+	// Params holds the wildcard segments captured by the matched route
+	Params map[string]string
+	// RemoteAddr is the address of the client that sent the request
+	RemoteAddr string
+	// ClientIP is the IP of the client, taken from the forwarding headers
+	// when -trust-proxy is set
+	ClientIP string
+	// Host is the host the request is for, from an absolute-form target or
+	// the host header
+	Host string
+	// ID identifies the request in logs and the x-request-id header
+	ID string
+	// RawQuery is the query string as sent, without the leading ?
+	RawQuery string
+}
+
+// Header holds request headers keyed by lowercase name, keeping every value
+// of headers that were sent more than once
+type Header map[string][]string
+
+// Get returns the first value of the header k, or "" if it wasn't sent
+func (h Header) Get(k string) string {
+	if v := h[strings.ToLower(k)]; len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// Values returns every value of the header k, in the order they were sent
+func (h Header) Values(k string) []string {
+	return h[strings.ToLower(k)]
+}
+
+func (h Header) Add(k, v string) {
+	k = strings.ToLower(k)
+	h[k] = append(h[k], v)
 }
 
 type Res struct {
@@ -32,61 +276,255 @@ type Res struct {
 	CType   string
 	Headers map[string]string
 	Body    []byte
+	// Stream, if set, is sent in place of Body and closed once written.
+	// StreamLen must hold the number of bytes it will yield, or -1 if that
+	// isn't known up front, in which case the body is sent chunked.
+	Stream    io.ReadCloser
+	StreamLen int64
+	// Trailers are sent after a chunked body. Their names are declared in a
+	// trailer header ahead of the body, so every name must be in the map
+	// before the response is written. Values are only read once Stream is
+	// exhausted, so the stream may fill those in as it goes.
+	Trailers map[string]string
+	// cookies are sent as a set-cookie header each, see SetCookie
+	cookies []string
+	// noChunking is set for clients that can't decode chunked bodies, so a
+	// stream of unknown length is ended by closing the connection instead
+	noChunking bool
+	// noBody is set for responses to HEAD requests
+	noBody bool
 }
 
 func (r *Res) StatusText() string {
 	switch r.Status {
+	case 100:
+		return "Continue"
 	case 200:
 		return "OK"
 	case 201:
 		return "Created"
+	case 204:
+		return "No Content"
+	case 206:
+		return "Partial Content"
+	case 301:
+		return "Moved Permanently"
+	case 302:
+		return "Found"
+	case 304:
+		return "Not Modified"
 	case 400:
 		return "Bad Request"
+	case 401:
+		return "Unauthorized"
+	case 403:
+		return "Forbidden"
 	case 404:
 		return "Not Found"
 	case 405:
 		return "Method Not Allowed"
+	case 406:
+		return "Not Acceptable"
+	case 408:
+		return "Request Timeout"
+	case 409:
+		return "Conflict"
+	case 412:
+		return "Precondition Failed"
+	case 413:
+		return "Payload Too Large"
+	case 415:
+		return "Unsupported Media Type"
+	case 416:
+		return "Range Not Satisfiable"
 	case 422:
 		return "Unprocessable Entity"
+	case 429:
+		return "Too Many Requests"
+	case 431:
+		return "Request Header Fields Too Large"
 	case 500:
 		return "Internal Server Error"
+	case 503:
+		return "Service Unavailable"
+	case 505:
+		return "HTTP Version Not Supported"
 	default:
 		return ""
 	}
 }
 
-func (r *Res) String(enc bool) string {
-	headersStr := ""
-	if r.Headers != nil {
-		// remove content-{encoding,length,type} from headers
-		delete(r.Headers, "content-encoding")
-		delete(r.Headers, "content-length")
-		delete(r.Headers, "content-type")
+// httpTimeFormat is the IMF-fixdate format used by Date and friends
+const httpTimeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+// now is the clock used for the Date header, swappable in tests
+var now = time.Now
+
+// String renders the response
+func (r *Res) String() string {
+	var b strings.Builder
+	r.WriteTo(&b)
+	return b.String()
+}
+
+// WriteTo writes the response to w. The body is handed to w as-is rather
+// than being copied in with the headers, which lets TCP connections use a
+// single writev.
+func (r *Res) WriteTo(w io.Writer) (int64, error) {
+	if r.Stream != nil {
+		defer r.Stream.Close()
+	}
+	head, body := r.render()
+	bufs := net.Buffers{[]byte(head), body}
+	n, err := bufs.WriteTo(w)
+	if err != nil || r.Stream == nil || r.noBody || r.Status == 204 || r.Status == 304 {
+		return n, err
+	}
+	var m int64
+	if r.StreamLen < 0 && !r.noChunking {
+		m, err = writeChunked(w, r.Stream, r.Trailers)
+	} else {
+		m, err = io.Copy(w, r.Stream)
+	}
+	return n + m, err
+}
+
+// writeChunked copies src to w in the chunked transfer-coding, followed by
+// the trailers
+func writeChunked(w io.Writer, src io.Reader, trailers map[string]string) (int64, error) {
+	var written int64
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			m, werr := fmt.Fprintf(w, "%x\r\n%s\r\n", n, buf[:n])
+			written += int64(m)
+			if werr != nil {
+				return written, werr
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+	end := "0\r\n"
+	for k, v := range trailers {
+		end += fmt.Sprintf("%s: %s\r\n", canonicalHeaderKey(k), v)
+	}
+	m, err := io.WriteString(w, end+"\r\n")
+	return written + int64(m), err
+}
 
-		for k, v := range r.Headers {
-			headersStr += fmt.Sprintf("%s: %s\r\n", strings.ToLower(k), v)
+// renderedHeaders are written by render itself, whatever Headers holds
+var renderedHeaders = []string{"content-length", "content-type", "date", "server", "trailer", "transfer-encoding"}
+
+// render returns the status line and headers, and the body to send after them
+func (r *Res) render() (string, []byte) {
+	headersStr := fmt.Sprintf("Date: %s\r\n", now().UTC().Format(httpTimeFormat))
+	if _, ok := extraHeaders["server"]; !ok && !noServerHeader {
+		headersStr += fmt.Sprintf("Server: codecrafters-http-go/%s\r\n", version)
+	}
+	for k, v := range r.Headers {
+		if !slices.Contains(renderedHeaders, strings.ToLower(k)) {
+			headersStr += fmt.Sprintf("%s: %s\r\n", canonicalHeaderKey(k), v)
 		}
 	}
-	if r.CType != "" {
-		headersStr += fmt.Sprintf("content-type: %s\r\n", r.CType)
+	// CType wins over a content-type set in Headers
+	ctype := r.CType
+	if ctype == "" {
+		ctype, _ = r.header("content-type")
 	}
-	if enc {
-		headersStr += "content-encoding: gzip\r\n"
-		buf := new(bytes.Buffer)
-		gzWriter := gzip.NewWriter(buf)
-		_, err := gzWriter.Write(r.Body)
-		gzWriter.Close()
-		if err == nil {
-			b := buf.Bytes()
-			headersStr += fmt.Sprintf("content-length: %d\r\n", len(b))
-			return fmt.Sprintf("HTTP/1.1 %d %s\r\n%s\r\n%s", r.Status, r.StatusText(), headersStr, string(b))
-		} else {
-			fmt.Fprintln(os.Stderr, "Could not compress to gzip:", err)
+	for k, v := range extraHeaders {
+		if _, ok := r.header(k); ok || (k == "content-type" && ctype != "") {
+			continue
 		}
-	} else {
-		headersStr += fmt.Sprintf("content-length: %d\r\n", len(r.Body))
+		headersStr += fmt.Sprintf("%s: %s\r\n", canonicalHeaderKey(k), v)
+	}
+	for _, cookie := range r.cookies {
+		headersStr += fmt.Sprintf("Set-Cookie: %s\r\n", cookie)
+	}
+	if ctype != "" {
+		headersStr += fmt.Sprintf("Content-Type: %s\r\n", withCharset(ctype))
+	}
+	if r.Status == 204 || r.Status == 304 {
+		// these must not carry a body, and don't need the length of one
+		return fmt.Sprintf("HTTP/1.1 %d %s\r\n%s\r\n", r.Status, r.StatusText(), headersStr), nil
+	}
+	if r.Stream != nil && r.StreamLen < 0 {
+		if !r.noChunking {
+			headersStr += "Transfer-Encoding: chunked\r\n"
+			if len(r.Trailers) > 0 {
+				names := make([]string, 0, len(r.Trailers))
+				for k := range r.Trailers {
+					names = append(names, canonicalHeaderKey(k))
+				}
+				slices.Sort(names)
+				headersStr += fmt.Sprintf("Trailer: %s\r\n", strings.Join(names, ", "))
+			}
+		}
+		return fmt.Sprintf("HTTP/1.1 %d %s\r\n%s\r\n", r.Status, r.StatusText(), headersStr), nil
+	}
+	if r.Stream != nil {
+		headersStr += fmt.Sprintf("Content-Length: %d\r\n", r.StreamLen)
+		return fmt.Sprintf("HTTP/1.1 %d %s\r\n%s\r\n", r.Status, r.StatusText(), headersStr), nil
+	}
+	body := r.Body
+	headersStr += fmt.Sprintf("Content-Length: %d\r\n", len(body))
+	if r.noBody {
+		// HEAD responses keep the content-length of the body they leave out
+		body = nil
+	}
+	return fmt.Sprintf("HTTP/1.1 %d %s\r\n%s\r\n", r.Status, r.StatusText(), headersStr), body
+}
+
+// headerKeyExceptions are spelled differently from what
+// textproto.CanonicalMIMEHeaderKey would make of them
+var headerKeyExceptions = map[string]string{
+	"etag":             "ETag",
+	"www-authenticate": "WWW-Authenticate",
+	"x-request-id":     "X-Request-ID",
+}
+
+// canonicalHeaderKey returns the conventional spelling of a header name, like
+// Content-Type, for writing it on the wire
+func canonicalHeaderKey(k string) string {
+	if canonical, ok := headerKeyExceptions[strings.ToLower(k)]; ok {
+		return canonical
+	}
+	return textproto.CanonicalMIMEHeaderKey(k)
+}
+
+// withCharset adds -default-charset to text/* content types without a charset
+func withCharset(ctype string) string {
+	if defaultCharset == "" || !strings.HasPrefix(strings.ToLower(ctype), "text/") {
+		return ctype
 	}
-	return fmt.Sprintf("HTTP/1.1 %d %s\r\n%s\r\n%s", r.Status, r.StatusText(), headersStr, string(r.Body))
+	if _, params, err := mime.ParseMediaType(ctype); err != nil || params["charset"] != "" {
+		return ctype
+	}
+	return ctype + "; charset=" + defaultCharset
+}
+
+// SetHeader sets a response header, creating the header map if needed
+func (r *Res) SetHeader(k, v string) {
+	if r.Headers == nil {
+		r.Headers = make(map[string]string)
+	}
+	r.Headers[strings.ToLower(k)] = v
+}
+
+// header looks up the header k in Headers, however its name was spelled by
+// a handler filling in the map directly rather than through SetHeader
+func (r *Res) header(k string) (string, bool) {
+	for name, v := range r.Headers {
+		if strings.EqualFold(name, k) {
+			return v, true
+		}
+	}
+	return "", false
 }
 
 func ErrRes(err error, status uint) *Res {
@@ -97,6 +535,40 @@ func ErrRes(err error, status uint) *Res {
 	}
 }
 
+// ServiceUnavailable returns a 503 asking the client to retry after the given
+// number of seconds, or without a retry-after header if retryAfter is 0
+func ServiceUnavailable(retryAfter int) *Res {
+	res := &Res{Status: 503}
+	if retryAfter > 0 {
+		res.SetHeader("retry-after", strconv.Itoa(retryAfter))
+	}
+	return res
+}
+
+// TooManyRequests returns a 429 asking the client to retry after the given
+// number of seconds
+func TooManyRequests(retryAfter int) *Res {
+	res := &Res{Status: 429}
+	res.SetHeader("retry-after", strconv.Itoa(retryAfter))
+	return res
+}
+
+// Redirect returns a response sending the client to location with the given
+// 3xx status
+func Redirect(status uint, location string) *Res {
+	res := &Res{Status: status}
+	res.SetHeader("location", location)
+	return res
+}
+
+// Unauthorized returns a 401 challenging the client for basic auth
+// credentials in the given realm
+func Unauthorized(realm string) *Res {
+	res := &Res{Status: 401}
+	res.SetHeader("www-authenticate", fmt.Sprintf("Basic realm=%q", realm))
+	return res
+}
+
 func h(contentType string, enc bool) map[string]string {
 	headers := map[string]string{
 		"content-type": contentType,
@@ -107,148 +579,1591 @@ func h(contentType string, enc bool) map[string]string {
 	return headers
 }
 
-func parseFirstLine(line string) (string, string, error) {
-	a, isHttp1_1 := strings.CutSuffix(line, "HTTP/1.1")
-	if !isHttp1_1 {
-		return "", "", errors.New("Only HTTP/1.1 is supported")
+// StatusError is an error that should be reported to the client with Status
+type StatusError struct {
+	Status uint
+	Msg    string
+}
+
+func (e *StatusError) Error() string {
+	return e.Msg
+}
+
+// errStatus returns the status an error should be reported with, or def
+// if it is not a StatusError.
+func errStatus(err error, def uint) uint {
+	var se *StatusError
+	if errors.As(err, &se) {
+		return se.Status
+	}
+	return def
+}
+
+var errVersionNotSupported = &StatusError{505, "Only HTTP/1.0 and HTTP/1.1 are supported"}
+
+func parseFirstLine(line string) (method string, target string, proto string, err error) {
+	// method, target and version, separated by single spaces
+	b := strings.Split(line, " ")
+	if len(b) != 3 || b[0] == "" || b[1] == "" {
+		return "", "", "", &StatusError{400, "Malformed request line"}
+	}
+	if !validMethod(b[0]) {
+		return "", "", "", &StatusError{400, "Invalid method"}
+	}
+	// the raw target ends up in headers like location, where a stray CR or
+	// LF would split the response
+	if strings.ContainsFunc(b[1], func(c rune) bool { return c < 0x20 || c == 0x7f }) {
+		return "", "", "", &StatusError{400, "Control character in request target"}
+	}
+	if !strings.HasPrefix(b[2], "HTTP/") {
+		return "", "", "", &StatusError{400, "Malformed HTTP version"}
+	}
+	if b[2] != "HTTP/1.1" && b[2] != "HTTP/1.0" {
+		return "", "", "", errVersionNotSupported
+	}
+	return b[0], b[1], b[2], nil
+}
+
+var knownMethods = []string{"GET", "HEAD", "POST", "PUT", "DELETE", "CONNECT", "OPTIONS", "TRACE", "PATCH"}
+
+// validMethod reports whether method is an RFC 9110 token. Methods are case
+// sensitive, so a lowercase spelling of a standard method is rejected too.
+func validMethod(method string) bool {
+	if method == "" {
+		return false
+	}
+	for _, c := range method {
+		if !(c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || strings.ContainsRune("!#$%&'*+-.^_`|~", c)) {
+			return false
+		}
+	}
+	for _, known := range knownMethods {
+		if strings.EqualFold(method, known) {
+			return method == known
+		}
 	}
-	b := strings.Split(a, " ")
-	return b[0], b[1], nil
+	return true
 }
 
-func parseHeaders(headersRaw string) map[string]string {
-	headers := make(map[string]string)
-	for _, str := range strings.Split(headersRaw, "\r\n") {
-		k, v, ok := strings.Cut(str, ":")
+func parseHeaders(headersRaw string) Header {
+	headers := make(Header)
+	for _, str := range strings.Split(headersRaw, "\n") {
+		// lines may end in either \r\n or a bare \n
+		k, v, ok := strings.Cut(strings.TrimSuffix(str, "\r"), ":")
 		if ok {
-			headers[strings.ToLower(strings.Trim(k, " "))] = strings.ToLower(strings.Trim(v, " "))
+			headers.Add(strings.Trim(k, " "), strings.Trim(v, " "))
 		}
 	}
 	return headers
 }
 
+// parseQuery decodes a query string, keeping the first value of repeated keys
+func parseQuery(rawQuery string) (map[string]string, error) {
+	values, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return nil, &StatusError{400, "Malformed query string"}
+	}
+	query := make(map[string]string, len(values))
+	for k, v := range values {
+		query[k] = v[0]
+	}
+	return query, nil
+}
+
+// findHeadersEnd returns the offset just past the empty line that ends the
+// header section of b, or -1 if it hasn't been received yet. Both \r\n and
+// bare \n line endings are accepted.
+func findHeadersEnd(b []byte) int {
+	for i, c := range b {
+		if c != '\n' {
+			continue
+		}
+		if bytes.HasPrefix(b[i+1:], []byte("\n")) {
+			return i + 2
+		}
+		if bytes.HasPrefix(b[i+1:], []byte("\r\n")) {
+			return i + 3
+		}
+	}
+	return -1
+}
+
 func parseRequest(req []byte) (*Req, error) {
-	// split[0] = first line and headers ; split[1] = body
-	split := strings.SplitN(string(req), "\r\n\r\n", 2)
-	// split2[0] = first line ; split2[1] = headers
-	split2 := strings.SplitN(split[0], "\r\n", 2)
-	method, path, err := parseFirstLine(split2[0])
+	headersEnd := findHeadersEnd(req)
+	if headersEnd < 0 {
+		return nil, &StatusError{400, "Incomplete request headers"}
+	}
+	head, body := strings.TrimRight(string(req[:headersEnd]), "\r\n"), req[headersEnd:]
+	// a request without headers has nothing after the first line
+	firstLine, headersRaw, _ := strings.Cut(head, "\n")
+	firstLine = strings.TrimSuffix(firstLine, "\r")
+	method, target, proto, err := parseFirstLine(firstLine)
+	if err != nil {
+		return nil, err
+	}
+	headers := parseHeaders(headersRaw)
+	host, rawPath, rawQuery, err := splitTarget(method, target)
+	if err != nil {
+		return nil, err
+	}
+	// HTTP/1.1 requests must name exactly one host, even if the target does
+	if hosts := headers.Values("host"); len(hosts) > 1 {
+		return nil, &StatusError{400, "Multiple host headers"}
+	} else if proto == "HTTP/1.1" && (len(hosts) == 0 || strings.TrimSpace(hosts[0]) == "") {
+		return nil, &StatusError{400, "Missing host header"}
+	}
+	if host == "" {
+		host = strings.TrimSpace(headers.Get("host"))
+	}
+	path, err := url.PathUnescape(rawPath)
+	if err != nil {
+		return nil, &StatusError{400, "Malformed path"}
+	}
+	query, err := parseQuery(rawQuery)
 	if err != nil {
 		return nil, err
 	}
-	headers := parseHeaders(split2[1])
+	if len(body) > 0 {
+		enc := strings.TrimSpace(headers.Get("content-encoding"))
+		if body, err = decompress(enc, body); err != nil {
+			return nil, err
+		}
+		// handlers only ever see the decoded body
+		delete(headers, "content-encoding")
+	}
 	return &Req{
 		Method:  method,
+		Proto:   proto,
 		Path:    path,
+		RawPath: rawPath,
+		Query:   query,
 		Headers: headers,
-		Body:    []byte(split[1]),
+		Body:    body,
+		// keep the query around for building redirects
+		RawQuery: rawQuery,
+		Host:     host,
 	}, nil
 }
 
-func handleSendFile(p string) *Res {
-	stat, err := os.Stat(p)
-	if err != nil {
-		if errors.Is(err, fs.ErrNotExist) {
-			return &Res{Status: 404}
-		} else {
-			return ErrRes(err, 500)
+// splitTarget splits a request target into the host it names, if any, and
+// its raw path and query. Targets may be in origin-form (/path?query),
+// absolute-form (http://host/path?query) as sent to proxies, or for OPTIONS
+// asterisk-form (*).
+func splitTarget(method, target string) (host, rawPath, rawQuery string, err error) {
+	if target == "*" && method == "OPTIONS" {
+		return "", "*", "", nil
+	}
+	if !strings.HasPrefix(target, "/") {
+		scheme, rest, ok := strings.Cut(target, "://")
+		if !ok || !(strings.EqualFold(scheme, "http") || strings.EqualFold(scheme, "https")) {
+			return "", "", "", &StatusError{400, "Unsupported request target"}
+		}
+		i := strings.IndexAny(rest, "/?")
+		if i < 0 {
+			i = len(rest)
+		}
+		host, target = rest[:i], rest[i:]
+		if host == "" || strings.Contains(host, "@") {
+			return "", "", "", &StatusError{400, "Unsupported request target"}
+		}
+		// an absolute-form target may leave out the path
+		if !strings.HasPrefix(target, "/") {
+			target = "/" + target
 		}
 	}
-	if stat.IsDir() {
-		return &Res{Status: 404}
+	rawPath, rawQuery, _ = strings.Cut(target, "?")
+	return host, rawPath, rawQuery, nil
+}
+
+var errBodyTooLarge = &StatusError{413, "Request body is too large"}
+var errHeadersTooLarge = &StatusError{431, "Request headers are too large"}
+var errReadTimeout = &StatusError{408, "Timed out reading request"}
+
+// readRequest reads the headers of the next request from r, followed by
+// the full body as announced by content-length. A chunked body is decoded and
+// returned in place of the chunks. Bytes past the end of the request stay
+// buffered in r for the next call.
+func readRequest(conn net.Conn, r *bufio.Reader) ([]byte, error) {
+	var buf []byte
+	for {
+		// ReadSlice rather than ReadBytes, so that an endless line can't grow
+		// past the limit before it's checked
+		line, err := r.ReadSlice('\n')
+		buf = append(buf, line...)
+		if len(buf) > maxHeaderBytes {
+			return nil, errHeadersTooLarge
+		}
+		if errors.Is(err, bufio.ErrBufferFull) {
+			continue
+		}
+		if err != nil {
+			if len(buf) > 0 && errors.Is(err, io.EOF) {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		// the request line is never the end of the headers, even if empty, and
+		// neither is the tail of a line longer than r's buffer
+		if bytes.HasSuffix(buf, []byte("\n\n")) || bytes.HasSuffix(buf, []byte("\n\r\n")) {
+			break
+		}
 	}
-	data, err := os.ReadFile(p)
-	if err != nil {
-		return ErrRes(err, 500)
+
+	contentLength := 0
+	// skip the request line, the rest are headers
+	_, headersRaw, _ := strings.Cut(string(buf), "\n")
+	headers := parseHeaders(headersRaw)
+	// clients sending expect: 100-continue wait for the go-ahead before the
+	// body, unless they've already started sending it
+	expectsContinue := strings.EqualFold(headers.Get("expect"), "100-continue") && r.Buffered() == 0
+	if te := headers.Values("transfer-encoding"); len(te) > 0 {
+		// the end of a body in any other final coding can't be found, and
+		// reading it some other way would let it pass for the next request
+		if !isChunked(strings.Join(te, ",")) {
+			return nil, &StatusError{400, "Unsupported transfer-encoding"}
+		}
+		// transfer-encoding takes precedence over content-length
+		if expectsContinue {
+			if err := writeContinue(conn); err != nil {
+				return nil, err
+			}
+		}
+		// trailers share the header limit with the headers already read
+		body, err := decodeChunked(r, maxHeaderBytes-len(buf))
+		if err != nil {
+			return nil, err
+		}
+		// hand the decoded body to parseRequest in place of the chunks
+		return append(buf, body...), nil
 	}
-	return &Res{
-		Status: 200,
-		CType:  "application/octet-stream",
-		Body:   []byte(data),
+	if cls := headers.Values("content-length"); len(cls) > 0 {
+		// repeated content-lengths must agree, or the body is ambiguous
+		if slices.ContainsFunc(cls, func(cl string) bool { return cl != cls[0] }) {
+			return nil, &StatusError{400, "Conflicting content-length"}
+		}
+		// Atoi would take a sign, which a proxy in front may not
+		if !allDigits(cls[0], "0123456789") {
+			return nil, &StatusError{400, "Invalid content-length"}
+		}
+		n, err := strconv.Atoi(cls[0])
+		if err != nil {
+			return nil, &StatusError{400, "Invalid content-length"}
+		}
+		contentLength = n
+	}
+	if contentLength > maxBodyBytes {
+		return nil, errBodyTooLarge
+	}
+	if expectsContinue && contentLength > 0 {
+		if err := writeContinue(conn); err != nil {
+			return nil, err
+		}
 	}
-}
 
-func handleCreateFile(p string, content []byte) *Res {
-	err := os.WriteFile(p, content, 0600)
-	if err != nil {
-		return ErrRes(err, 500)
-	} else {
-		return &Res{Status: 201}
+	headersEnd := len(buf)
+	buf = append(buf, make([]byte, contentLength)...)
+	if _, err := io.ReadFull(r, buf[headersEnd:]); err != nil {
+		return nil, err
 	}
+	return buf, nil
 }
 
-func handleConnection(conn net.Conn) {
-	defer conn.Close()
-	fmt.Printf("Received TCP Connection from %s\n", conn.RemoteAddr())
+// allDigits reports whether s is made up only of digits, and isn't empty
+func allDigits(s, digits string) bool {
+	return s != "" && strings.Trim(s, digits) == ""
+}
 
-	b := make([]byte, 1024)
-	_, err := conn.Read(b)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Could not read from TCP connection %s: %s\n", conn.RemoteAddr().String(), err)
-		return
+// writeContinue sends the interim response a client waits for after sending
+// expect: 100-continue
+func writeContinue(conn net.Conn) error {
+	conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err := fmt.Fprintf(conn, "HTTP/1.1 100 %s\r\n\r\n", (&Res{Status: 100}).StatusText())
+	return err
+}
+
+// isChunked reports whether chunked is the final transfer-coding applied
+func isChunked(transferEncoding string) bool {
+	codings := strings.Split(transferEncoding, ",")
+	return strings.EqualFold(strings.TrimSpace(codings[len(codings)-1]), "chunked")
+}
+
+// decodeChunked reads a chunked body from r, returning the reassembled body.
+// The final chunk and any trailers are consumed as well, the trailers taking
+// up to trailerLimit bytes.
+func decodeChunked(r *bufio.Reader, trailerLimit int) ([]byte, error) {
+	body := []byte{}
+	for {
+		// chunk extensions are unbounded, so size lines get the header limit
+		line, err := readLine(r, maxHeaderBytes, errHeadersTooLarge)
+		if err != nil {
+			return nil, err
+		}
+		// chunk extensions after ; are ignored
+		sizeStr, _, _ := strings.Cut(line, ";")
+		sizeStr = strings.TrimSpace(sizeStr)
+		if !allDigits(sizeStr, "0123456789abcdefABCDEF") {
+			return nil, &StatusError{400, "Malformed chunk size"}
+		}
+		size, err := strconv.ParseInt(sizeStr, 16, 64)
+		if err != nil {
+			return nil, &StatusError{400, "Malformed chunk size"}
+		}
+
+		if size == 0 {
+			// skip any trailers, up to the empty line that ends the body
+			for {
+				line, err := readLine(r, trailerLimit, errHeadersTooLarge)
+				if err != nil {
+					return nil, err
+				}
+				trailerLimit -= len(line)
+				if line == "\r\n" || line == "\n" {
+					return body, nil
+				}
+			}
+		}
+
+		if size > int64(maxBodyBytes-len(body)) {
+			return nil, errBodyTooLarge
+		}
+		chunk := make([]byte, size+2)
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return nil, err
+		}
+		if !bytes.HasSuffix(chunk, []byte("\r\n")) {
+			return nil, &StatusError{400, "Malformed chunk"}
+		}
+		body = append(body, chunk[:size]...)
 	}
+}
 
-	for i, v := range b {
-		if v == 0 {
-			b = b[:i]
-			break
+// readLine reads a line from r including its \n, failing with tooLarge once
+// it is longer than limit
+func readLine(r *bufio.Reader, limit int, tooLarge error) (string, error) {
+	var line []byte
+	for {
+		// ReadSlice rather than ReadString, for the same reason as in
+		// readRequest
+		part, err := r.ReadSlice('\n')
+		line = append(line, part...)
+		if len(line) > limit {
+			return "", tooLarge
+		}
+		if errors.Is(err, bufio.ErrBufferFull) {
+			continue
+		}
+		if err != nil {
+			return "", err
 		}
+		return string(line), nil
 	}
+}
 
-	req, err := parseRequest(b)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Could not parse HTTP request from TCP connection %s: %s\n", conn.RemoteAddr().String(), err)
-		conn.Write([]byte((ErrRes(err, 422)).String(false)))
+// safeJoin joins name onto root, reporting false if the result would escape root
+func safeJoin(root, name string) (string, bool) {
+	p := filepath.Join(root, filepath.FromSlash(name))
+	rel, err := filepath.Rel(root, p)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
 	}
-	enc := strings.Contains(req.Headers["accept-encoding"], "gzip")
+	return p, true
+}
 
-	if req.Path == "/" {
-		conn.Write([]byte((&Res{Status: 200}).String(enc)))
-	} else if req.Path == "/user-agent" {
-		conn.Write([]byte((&Res{
-			Status: 200,
-			CType:  "text/plain",
-			Body:   []byte(req.Headers["user-agent"]),
-		}).String(enc)))
-	} else {
-		echoStr, echoOk := strings.CutPrefix(req.Path, "/echo/")
-		filesStr, filesOk := strings.CutPrefix(req.Path, "/files/")
-		if echoOk {
-			conn.Write([]byte((&Res{
-				Status: 200,
-				CType:  "text/plain",
-				Body:   []byte(echoStr),
-			}).String(enc)))
-		} else if filesOk && directory[0] == '/' {
-			p := path.Join(directory, filesStr)
-			if req.Method == "GET" {
-				conn.Write([]byte(handleSendFile(p).String(enc)))
-			} else if req.Method == "POST" {
-				conn.Write([]byte(handleCreateFile(p, req.Body).String(enc)))
-			} else {
-				conn.Write([]byte((&Res{Status: 405}).String(enc)))
-			}
-		} else {
-			conn.Write([]byte((&Res{Status: 404}).String(enc)))
-		}
+// mimeTypes takes precedence over the system mime database, so common types
+// are served the same way regardless of what is installed
+var mimeTypes = map[string]string{
+	".html": "text/html",
+	".htm":  "text/html",
+	".css":  "text/css",
+	".js":   "text/javascript",
+	".json": "application/json",
+	".txt":  "text/plain",
+	".png":  "image/png",
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".gif":  "image/gif",
+	".svg":  "image/svg+xml",
+	".ico":  "image/x-icon",
+	".pdf":  "application/pdf",
+	".wasm": "application/wasm",
+}
+
+func contentTypeFor(p string) string {
+	ext := strings.ToLower(filepath.Ext(p))
+	if t, ok := mimeTypes[ext]; ok {
+		return t
 	}
+	if t := mime.TypeByExtension(ext); t != "" {
+		// drop parameters like charset
+		t, _, _ = strings.Cut(t, ";")
+		return t
+	}
+	return "application/octet-stream"
 }
 
-func main() {
-	server, err := net.Listen("tcp", "0.0.0.0:4221")
-	if err != nil {
-		fmt.Println("Failed to bind to port 4221")
-		os.Exit(1)
+// fileErrRes turns a filesystem error into a response, 403 if the server
+// isn't allowed to access the file and 500 otherwise
+func fileErrRes(err error) *Res {
+	if errors.Is(err, fs.ErrPermission) {
+		return ErrRes(errors.New("Permission denied"), 403)
 	}
-	fmt.Println("Listening on port 4221")
+	return ErrRes(err, 500)
+}
 
-	for {
-		conn, err := server.Accept()
-		if err != nil {
-			fmt.Fprintln(os.Stderr, "Could not accept TCP connection: "+err.Error())
-			continue
-		}
+func handleSendFile(ctx context.Context, p string, req *Req) *Res {
+	stat, err := os.Stat(p)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return &Res{Status: 404}
+		} else {
+			return fileErrRes(err)
+		}
+	}
+	if stat.IsDir() {
+		if autoindex {
+			return handleListDir(p, req)
+		}
+		return &Res{Status: 404}
+	}
+	ctype := contentTypeFor(p)
+	// serve a precompressed p.gz in its place to clients that take gzip,
+	// unless they want a range of the uncompressed file
+	vary, contentEncoding := false, ""
+	if gzStat, err := os.Stat(p + ".gz"); err == nil && gzStat.Mode().IsRegular() {
+		vary = true
+		if acceptsGzip(req) && req.Headers.Get("range") == "" {
+			p, stat, contentEncoding = p+".gz", gzStat, "gzip"
+		}
+	}
+	// http dates only have second precision
+	lastModified := stat.ModTime().UTC().Truncate(time.Second)
+	etag := fileETag(stat)
+	notModified := false
+	// if-none-match takes precedence over if-modified-since
+	if inm := req.Headers.Values("if-none-match"); len(inm) > 0 {
+		notModified = etagMatches(strings.Join(inm, ","), etag)
+	} else if ims, err := time.Parse(httpTimeFormat, req.Headers.Get("if-modified-since")); err == nil {
+		notModified = !lastModified.After(ims)
+	}
+	if notModified {
+		res := &Res{Status: 304}
+		res.SetHeader("last-modified", lastModified.Format(httpTimeFormat))
+		res.SetHeader("etag", etag)
+		if cacheControl != "" {
+			res.SetHeader("cache-control", cacheControl)
+		}
+		if vary {
+			res.SetHeader("vary", "Accept-Encoding")
+		}
+		return res
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return fileErrRes(err)
+	}
+	size := stat.Size()
+	res := &Res{
+		Status:    200,
+		CType:     ctype,
+		Stream:    f,
+		StreamLen: size,
+	}
+	res.SetHeader("accept-ranges", "bytes")
+	res.SetHeader("last-modified", lastModified.Format(httpTimeFormat))
+	res.SetHeader("etag", etag)
+	if cacheControl != "" {
+		res.SetHeader("cache-control", cacheControl)
+	}
+	if vary {
+		res.SetHeader("vary", "Accept-Encoding")
+	}
+	if contentEncoding != "" {
+		res.SetHeader("content-encoding", contentEncoding)
+	}
+	if rangeHeader := req.Headers.Get("range"); rangeHeader != "" {
+		start, end, ok, err := parseRange(rangeHeader, int(size))
+		if err != nil {
+			f.Close()
+			res = ErrRes(err, 416)
+			res.SetHeader("content-range", fmt.Sprintf("bytes */%d", size))
+			return res
+		}
+		if ok {
+			if _, err := f.Seek(int64(start), io.SeekStart); err != nil {
+				f.Close()
+				return fileErrRes(err)
+			}
+			res.Status = 206
+			res.StreamLen = int64(end - start + 1)
+			res.Stream = struct {
+				io.Reader
+				io.Closer
+			}{io.LimitReader(f, res.StreamLen), f}
+			res.SetHeader("content-range", fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+		}
+	}
+	res.Stream = contextReader{ctx, res.Stream}
+	return res
+}
+
+// contextReader fails reads once ctx is done, so a file being streamed to a
+// client that has hung up isn't read to the end
+type contextReader struct {
+	ctx context.Context
+	io.ReadCloser
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.ReadCloser.Read(p)
+}
+
+func fileETag(stat fs.FileInfo) string {
+	return fmt.Sprintf("\"%x-%x\"", stat.Size(), stat.ModTime().UnixNano())
+}
+
+// etagMatchesStrong reports whether an if-match header matches etag, using
+// the strong comparison: weak etags never match
+func etagMatchesStrong(ifMatch, etag string) bool {
+	if strings.TrimSpace(ifMatch) == "*" {
+		return true
+	}
+	for _, candidate := range strings.Split(ifMatch, ",") {
+		if strings.TrimSpace(candidate) == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// etagMatches reports whether an if-none-match header matches etag, using
+// the weak comparison
+func etagMatches(ifNoneMatch, etag string) bool {
+	if strings.TrimSpace(ifNoneMatch) == "*" {
+		return true
+	}
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(candidate), "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+var errRangeNotSatisfiable = errors.New("Range not satisfiable")
+
+// parseRange parses a single "bytes=start-end" range for a body of the given
+// size, returning inclusive offsets. ok is false if the header is malformed
+// or asks for several ranges, in which case it should be ignored; err is set
+// if the range lies outside the body.
+func parseRange(header string, size int) (start, end int, ok bool, err error) {
+	spec, isBytes := strings.CutPrefix(strings.TrimSpace(header), "bytes=")
+	if !isBytes || strings.Contains(spec, ",") {
+		return 0, 0, false, nil
+	}
+	first, last, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return 0, 0, false, nil
+	}
+	if first == "" {
+		// bytes=-n means the last n bytes
+		n, err := strconv.Atoi(last)
+		if err != nil || n < 0 {
+			return 0, 0, false, nil
+		}
+		if n == 0 || size == 0 {
+			return 0, 0, false, errRangeNotSatisfiable
+		}
+		return max(size-n, 0), size - 1, true, nil
+	}
+	start, err = strconv.Atoi(first)
+	if err != nil || start < 0 {
+		return 0, 0, false, nil
+	}
+	end = size - 1
+	if last != "" {
+		end, err = strconv.Atoi(last)
+		if err != nil || end < start {
+			return 0, 0, false, nil
+		}
+	}
+	if start >= size {
+		return 0, 0, false, errRangeNotSatisfiable
+	}
+	return start, min(end, size-1), true, nil
+}
+
+// handleListDir renders an HTML index of the entries in the directory p
+func handleListDir(p string, req *Req) *Res {
+	entries, err := os.ReadDir(p)
+	if err != nil {
+		return fileErrRes(err)
+	}
+	base := strings.TrimSuffix(req.RawPath, "/")
+	title := html.EscapeString(req.Path)
+	body := fmt.Sprintf("<!DOCTYPE html>\n<html>\n<head><title>Index of %s</title></head>\n<body>\n<h1>Index of %s</h1>\n<ul>\n", title, title)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() {
+			name += "/"
+		}
+		href := base + "/" + url.PathEscape(entry.Name())
+		body += fmt.Sprintf("<li><a href=\"%s\">%s</a></li>\n", html.EscapeString(href), html.EscapeString(name))
+	}
+	body += "</ul>\n</body>\n</html>\n"
+	res := &Res{
+		Status: 200,
+		CType:  "text/html",
+		Body:   []byte(body),
+	}
+	if listingCacheControl != "" {
+		res.SetHeader("cache-control", listingCacheControl)
+	}
+	return res
+}
+
+// defaultFileMode is used for created files unless the client asks otherwise
+const defaultFileMode fs.FileMode = 0644
+
+// parseFileMode parses an octal mode like 0640, rejecting modes that would
+// leave the file unreadable to the server or writable by other users
+func parseFileMode(s string) (fs.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("Invalid file mode %q", s)
+	}
+	if mode&0400 == 0 || mode&0022 != 0 {
+		return 0, fmt.Errorf("File mode %q is not allowed", s)
+	}
+	return fs.FileMode(mode), nil
+}
+
+var errIsDirectory = errors.New("A directory exists at this path")
+
+// handleCreateFile writes content to p with the given mode. If exclusive is
+// set the file must not exist yet, otherwise it is overwritten.
+func handleCreateFile(p string, content []byte, mode fs.FileMode, exclusive bool) *Res {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if exclusive {
+		flags |= os.O_EXCL
+	}
+	f, err := os.OpenFile(p, flags, mode)
+	if err != nil {
+		if errors.Is(err, fs.ErrExist) {
+			return ErrRes(errors.New("File already exists"), 412)
+		}
+		if errors.Is(err, syscall.EISDIR) {
+			return ErrRes(errIsDirectory, 409)
+		}
+		return fileErrRes(err)
+	}
+	// the mode passed to OpenFile is subject to the umask and doesn't apply
+	// to existing files
+	err = f.Chmod(mode)
+	if err == nil {
+		_, err = f.Write(content)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fileErrRes(err)
+	} else {
+		return &Res{Status: 201}
+	}
+}
+
+// handleUpdateFile overwrites the existing file p. A non-empty ifMatch must
+// match the file's current etag, so clients don't clobber changes they
+// haven't seen.
+func handleUpdateFile(p string, content []byte, ifMatch string) *Res {
+	stat, err := os.Stat(p)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			if ifMatch != "" {
+				return &Res{Status: 412}
+			}
+			return &Res{Status: 404}
+		} else {
+			return fileErrRes(err)
+		}
+	}
+	if stat.IsDir() {
+		return ErrRes(errIsDirectory, 409)
+	}
+	if ifMatch != "" && !etagMatchesStrong(ifMatch, fileETag(stat)) {
+		return &Res{Status: 412}
+	}
+	err = os.WriteFile(p, content, stat.Mode().Perm())
+	if err != nil {
+		return fileErrRes(err)
+	}
+	return &Res{Status: 200}
+}
+
+// handleAppendFile appends content to the existing file p
+func handleAppendFile(p string, content []byte) *Res {
+	stat, err := os.Stat(p)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return &Res{Status: 404}
+		}
+		return fileErrRes(err)
+	}
+	if stat.IsDir() {
+		return ErrRes(errIsDirectory, 409)
+	}
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return fileErrRes(err)
+	}
+	_, err = f.Write(content)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fileErrRes(err)
+	}
+	return &Res{Status: 200}
+}
+
+// handleDeleteFile removes the file p. Directories are removed if empty, or
+// with everything in them if recursive is set.
+func handleDeleteFile(p string, recursive bool) *Res {
+	stat, err := os.Stat(p)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return &Res{Status: 404}
+		} else {
+			return fileErrRes(err)
+		}
+	}
+	if stat.IsDir() && recursive {
+		err = os.RemoveAll(p)
+	} else {
+		err = os.Remove(p)
+	}
+	if err != nil {
+		if errors.Is(err, syscall.ENOTEMPTY) || errors.Is(err, syscall.EEXIST) {
+			return ErrRes(errors.New("Directory is not empty, delete with ?recursive=true to remove its contents too"), 409)
+		}
+		return fileErrRes(err)
+	}
+	return &Res{Status: 204}
+}
+
+// clientIP returns the IP of the client that made req. Behind a trusted proxy
+// that is the last address in the forwarding headers, the one the proxy
+// added; those before it came from the client and could be spoofed, as could
+// the headers without a proxy, when the peer address is used.
+func clientIP(req *Req) string {
+	if trustProxy {
+		if xff := req.Headers.Values("x-forwarded-for"); len(xff) > 0 {
+			addrs := strings.Split(strings.Join(xff, ","), ",")
+			if ip := strings.TrimSpace(addrs[len(addrs)-1]); ip != "" {
+				return ip
+			}
+		}
+		if ip := forwardedFor(strings.Join(req.Headers.Values("forwarded"), ",")); ip != "" {
+			return ip
+		}
+	}
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return ip
+}
+
+// forwardedFor returns the address in the for parameter of the last element
+// of a forwarded header, without any port
+func forwardedFor(forwarded string) string {
+	elems := strings.Split(forwarded, ",")
+	for _, pair := range strings.Split(elems[len(elems)-1], ";") {
+		k, v, _ := strings.Cut(pair, "=")
+		if !strings.EqualFold(strings.TrimSpace(k), "for") {
+			continue
+		}
+		v = strings.Trim(strings.TrimSpace(v), "\"")
+		// IPv6 addresses are bracketed, with the port outside
+		if host, _, err := net.SplitHostPort(v); err == nil {
+			return host
+		}
+		return strings.Trim(v, "[]")
+	}
+	return ""
+}
+
+// wantsKeepAlive reports whether the client expects the connection to stay
+// open after req. HTTP/1.1 connections are persistent unless closed
+// explicitly, HTTP/1.0 ones only if the client asks for keep-alive.
+func wantsKeepAlive(req *Req) bool {
+	connection := req.Headers.Get("connection")
+	if req.Proto == "HTTP/1.0" {
+		return strings.EqualFold(connection, "keep-alive")
+	}
+	return !strings.EqualFold(connection, "close")
+}
+
+// acceptConns serves the connections accepted from server until it is closed.
+// wg tracks the connections still being served.
+func acceptConns(server net.Listener, router *Router, connSlots chan struct{}, wg *sync.WaitGroup) {
+	for {
+		conn, err := server.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			fmt.Fprintln(os.Stderr, "Could not accept TCP connection: "+err.Error())
+			continue
+		}
+
+		if connSlots != nil {
+			select {
+			case connSlots <- struct{}{}:
+			default:
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					rejectConnection(conn)
+				}()
+				continue
+			}
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if connSlots != nil {
+				defer func() { <-connSlots }()
+			}
+			handleConnection(conn, router)
+		}()
+	}
+}
+
+// rejectConnection turns away a connection when the server is at -max-conns
+func rejectConnection(conn net.Conn) {
+	defer conn.Close()
+	fmt.Fprintf(os.Stderr, "Rejecting TCP connection from %s: too many connections\n", conn.RemoteAddr())
+	res := ServiceUnavailable(1)
+	res.SetHeader("connection", "close")
+	if writeResponse(conn, res) == nil {
+		// the request is never read, which would reset the connection
+		lingerClose(conn)
+	}
+}
+
+func handleConnection(conn net.Conn, router *Router) {
+	defer conn.Close()
+	activeConns.Add(1)
+	defer activeConns.Add(-1)
+
+	// serve requests until the client asks to close or goes away. The
+	// buffered reader keeps whatever the client pipelined after a request.
+	r := bufio.NewReader(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(readTimeout))
+		b, err := readRequest(conn, r)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return
+			}
+			fmt.Fprintf(os.Stderr, "Could not read from TCP connection %s: %s\n", conn.RemoteAddr().String(), err)
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				err = errReadTimeout
+			}
+			if status := errStatus(err, 0); status != 0 {
+				res := ErrRes(err, status)
+				res.SetHeader("connection", "close")
+				writeResponse(conn, res)
+				lingerClose(conn)
+			}
+			return
+		}
+
+		req, err := parseRequest(b)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not parse HTTP request from TCP connection %s: %s\n", conn.RemoteAddr().String(), err)
+			res := ErrRes(err, errStatus(err, 422))
+			res.SetHeader("connection", "close")
+			writeResponse(conn, res)
+			return
+		}
+		req.RemoteAddr = conn.RemoteAddr().String()
+		req.ClientIP = clientIP(req)
+		keepAlive := wantsKeepAlive(req) && !shuttingDown.Load()
+		if req.Headers.Get("transfer-encoding") != "" && req.Headers.Get("content-length") != "" {
+			// the body was read as chunked, but a proxy in front may have gone by
+			// content-length, so nothing more is read from the connection
+			delete(req.Headers, "content-length")
+			keepAlive = false
+		}
+
+		// cancel the request's context if the client resets the connection
+		// before the response has been written, unless it has already
+		// pipelined more requests. Streamed bodies are read while writing, so
+		// the context lives until then.
+		ctx, cancel := context.WithCancel(context.Background())
+		var stopWatch func()
+		if r.Buffered() == 0 {
+			stopWatch = watchConn(conn, r, cancel)
+		}
+		res := router.ServeReq(ctx, req)
+		res.noBody = req.Method == "HEAD"
+		if res.Stream != nil && res.StreamLen < 0 && req.Proto == "HTTP/1.0" {
+			// HTTP/1.0 has no chunking, only closing the connection can end the body
+			res.noChunking = true
+			keepAlive = false
+		}
+		if corsOrigin != "" {
+			res.SetHeader("access-control-allow-origin", corsOrigin)
+		}
+		if keepAlive {
+			res.SetHeader("connection", "keep-alive")
+		} else {
+			res.SetHeader("connection", "close")
+		}
+		err = writeResponse(conn, res)
+		if stopWatch != nil {
+			stopWatch()
+		}
+		cancel()
+		if err != nil {
+			return
+		}
+		if !keepAlive {
+			lingerClose(conn)
+			return
+		}
+		if !waitForRequest(conn, r) {
+			return
+		}
+	}
+}
+
+// writeResponse writes res to conn, giving up after -write-timeout so a
+// client that stops reading can't hold the connection forever
+func writeResponse(conn net.Conn, res *Res) error {
+	conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	n, err := res.WriteTo(conn)
+	recordResponse(res.Status, int(n))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not write response to TCP connection %s: %s\n", conn.RemoteAddr(), err)
+	}
+	return err
+}
+
+// idle holds the keep-alive connections waiting for their next request, for
+// shutdown to close them rather than wait out -idle-timeout
+var idle = struct {
+	sync.Mutex
+	conns map[net.Conn]struct{}
+}{conns: make(map[net.Conn]struct{})}
+
+// waitForRequest waits up to -idle-timeout for the client to start sending
+// its next request, reporting false if it doesn't, closes the connection, or
+// the server shuts down in the meantime
+func waitForRequest(conn net.Conn, r *bufio.Reader) bool {
+	if r.Buffered() > 0 {
+		return true
+	}
+	idleConns.Add(1)
+	defer idleConns.Add(-1)
+	idle.Lock()
+	if shuttingDown.Load() {
+		idle.Unlock()
+		return false
+	}
+	idle.conns[conn] = struct{}{}
+	conn.SetReadDeadline(time.Now().Add(idleTimeout))
+	idle.Unlock()
+	_, err := r.Peek(1)
+	idle.Lock()
+	delete(idle.conns, conn)
+	idle.Unlock()
+	return err == nil
+}
+
+// shutdown stops accepting connections on listeners and wakes the idle ones
+// so they close. Connections in the middle of a request are closed once it
+// has been answered.
+func shutdown(listeners []net.Listener) {
+	shuttingDown.Store(true)
+	for _, server := range listeners {
+		server.Close()
+	}
+	idle.Lock()
+	defer idle.Unlock()
+	for conn := range idle.conns {
+		conn.SetReadDeadline(time.Now())
+	}
+}
+
+// lingerClose stops writing to conn and discards what the client still sends
+// for a moment. The client sees a clean EOF after the response, and closing
+// a connection with unread request data doesn't reset it before the client
+// has read the response.
+func lingerClose(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	io.Copy(io.Discard, conn)
+}
+
+// watchConn reads from conn through r in the background, calling cancel if
+// the connection is reset. Anything that arrives in the meantime stays
+// buffered in r. An EOF only means the client is done sending, as it may
+// close its side once the request is out and still read the response. The
+// returned stop function ends the watch.
+func watchConn(conn net.Conn, r *bufio.Reader, cancel context.CancelFunc) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		if _, err := r.Peek(1); err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, os.ErrDeadlineExceeded) {
+			cancel()
+		}
+		close(done)
+	}()
+	return func() {
+		// unblock the pending read
+		conn.SetReadDeadline(time.Now())
+		<-done
+	}
+}
+
+// recoverPanics is middleware answering with a 500 if the handler panics, so
+// the client still gets a response and the connection survives
+func recoverPanics(next HandlerFunc) HandlerFunc {
+	return func(ctx context.Context, req *Req) (res *Res) {
+		defer func() {
+			if err := recover(); err != nil {
+				fmt.Fprintf(os.Stderr, "Panic serving %s %s: %v\n%s", req.Method, req.RawPath, err, debug.Stack())
+				res = &Res{Status: 500}
+			}
+		}()
+		return next(ctx, req)
+	}
+}
+
+// traceHiddenHeaders are left out of TRACE responses, as they may hold
+// credentials
+var traceHiddenHeaders = []string{"authorization", "cookie", "proxy-authorization"}
+
+// answerTrace is middleware answering TRACE requests to any path with the
+// request line and headers as received
+func answerTrace(next HandlerFunc) HandlerFunc {
+	return func(ctx context.Context, req *Req) *Res {
+		if req.Method != "TRACE" {
+			return next(ctx, req)
+		}
+		target := req.RawPath
+		if req.RawQuery != "" {
+			target += "?" + req.RawQuery
+		}
+		body := fmt.Sprintf("TRACE %s %s\r\n", target, req.Proto)
+		names := make([]string, 0, len(req.Headers))
+		for k := range req.Headers {
+			if !slices.Contains(traceHiddenHeaders, k) {
+				names = append(names, k)
+			}
+		}
+		slices.Sort(names)
+		for _, k := range names {
+			for _, v := range req.Headers[k] {
+				body += fmt.Sprintf("%s: %s\r\n", canonicalHeaderKey(k), v)
+			}
+		}
+		return &Res{
+			Status: 200,
+			CType:  "message/http",
+			Body:   []byte(body + "\r\n"),
+		}
+	}
+}
+
+// overridableMethods are the methods x-http-method-override may ask for
+var overridableMethods = []string{"PUT", "PATCH", "DELETE"}
+
+// overrideMethods is middleware routing POST requests as the method named in
+// their x-http-method-override header, for clients that can only send GET
+// and POST. Without -allow-method-override they are refused, rather than
+// run as the POST they didn't mean.
+func overrideMethods(next HandlerFunc) HandlerFunc {
+	return func(ctx context.Context, req *Req) *Res {
+		override := strings.TrimSpace(req.Headers.Get("x-http-method-override"))
+		// a disabled POST must not get past the router as another method, so
+		// it is left for the router to refuse
+		if req.Method != "POST" || override == "" || slices.Contains(disabledMethods, "POST") {
+			return next(ctx, req)
+		}
+		if !allowMethodOverride {
+			return ErrRes(errors.New("Method override is off, start the server with -allow-method-override to use x-http-method-override"), 400)
+		}
+		if !slices.Contains(overridableMethods, override) {
+			return ErrRes(fmt.Errorf("Cannot override POST with %q", override), 400)
+		}
+		req.Method = override
+		return next(ctx, req)
+	}
+}
+
+func newRouter() *Router {
+	router := NewRouter()
+	router.RedirectTrailingSlash = true
+	router.DisabledMethods = disabledMethods
+	router.Use(assignRequestIDs)
+	router.Use(logRequests)
+	router.Use(recoverPanics)
+	// every request counts against the rate limit, so it goes ahead of the
+	// middleware answering TRACE and rewriting methods
+	if rateLimit > 0 {
+		limiter := newRateLimiter(rateLimit, rateBurst)
+		go limiter.cleanupEvery(time.Minute)
+		router.Use(limiter.limitRequests)
+	}
+	// answerTrace runs ahead of the routes, so it must not when TRACE is
+	// disabled
+	if allowTrace && !slices.Contains(disabledMethods, "TRACE") {
+		router.Use(answerTrace)
+		router.AlwaysAllowed = append(router.AlwaysAllowed, "TRACE")
+	}
+	router.Use(overrideMethods)
+	router.Use(compressResponses)
+	router.Handle("GET", "/", func(ctx context.Context, req *Req) *Res {
+		if indexFile == "" {
+			return &Res{Status: 200}
+		}
+		dir := hostDirectory(req, directory)
+		if dir == "" {
+			return &Res{Status: 404}
+		}
+		p, ok := safeJoin(dir, indexFile)
+		if !ok {
+			return &Res{Status: 403}
+		}
+		return handleSendFile(ctx, p, req)
+	})
+	router.Handle("GET", "/user-agent", func(ctx context.Context, req *Req) *Res {
+		return &Res{
+			Status: 200,
+			CType:  "text/plain",
+			Body:   []byte(req.Headers.Get("user-agent")),
+		}
+	})
+	router.Handle("GET", "/echo/{rest...}", handleEcho)
+	router.Handle("GET", "/health", handleHealth)
+	router.Handle("GET", "/metrics", handleMetrics)
+	router.Handle("POST", "/submit", handleSubmit)
+	if directory != "" {
+		router.Handle("POST", "/upload", requireAuth(handleUpload))
+	}
+	if notFoundFile != "" {
+		router.NotFound = handleNotFoundFile
+	}
+
+	// /files/ is always routed, to explain why nothing is served there or to
+	// serve it from a -vhost directory
+	roots := maps.Clone(mounts)
+	if _, ok := roots["/files/"]; !ok {
+		roots["/files/"] = ""
+	}
+	// register longer prefixes first so nested mounts take precedence
+	prefixes := make([]string, 0, len(roots))
+	for prefix := range roots {
+		prefixes = append(prefixes, prefix)
+	}
+	slices.SortFunc(prefixes, func(a, b string) int {
+		return len(b) - len(a)
+	})
+	for _, prefix := range prefixes {
+		root := roots[prefix]
+		pattern := prefix + "{name...}"
+		router.Handle("GET", pattern, requireAuth(filesHandler(prefix, root, handleSendFile)))
+		router.Handle("POST", pattern, requireAuth(filesHandler(prefix, root, func(ctx context.Context, p string, req *Req) *Res {
+			mode := defaultFileMode
+			if m, ok := req.Query["mode"]; ok {
+				var err error
+				if mode, err = parseFileMode(m); err != nil {
+					return ErrRes(err, 400)
+				}
+			}
+			// if-none-match: * asks to only create the file if it doesn't exist
+			res := handleCreateFile(p, req.Body, mode, strings.TrimSpace(req.Headers.Get("if-none-match")) == "*")
+			if res.Status == 201 {
+				res.SetHeader("location", req.RawPath)
+			}
+			return res
+		})))
+		router.Handle("PUT", pattern, requireAuth(filesHandler(prefix, root, func(ctx context.Context, p string, req *Req) *Res {
+			return handleUpdateFile(p, req.Body, strings.Join(req.Headers.Values("if-match"), ","))
+		})))
+		router.Handle("PATCH", pattern, requireAuth(filesHandler(prefix, root, func(ctx context.Context, p string, req *Req) *Res {
+			// appending is the only kind of patch there is
+			if !strings.EqualFold(strings.TrimSpace(req.Headers.Get("x-append")), "true") {
+				return ErrRes(errors.New("PATCH needs x-append: true"), 400)
+			}
+			if !req.hasMediaType("application/octet-stream") {
+				return ErrRes(errors.New("Expected content-type application/octet-stream"), 415)
+			}
+			return handleAppendFile(p, req.Body)
+		})))
+		router.Handle("DELETE", pattern, requireAuth(filesHandler(prefix, root, func(ctx context.Context, p string, req *Req) *Res {
+			if path.Clean("/"+req.Params["name"]) == "/" {
+				// the mount itself isn't a file of it
+				return &Res{Status: 403}
+			}
+			return handleDeleteFile(p, req.Query["recursive"] == "true")
+		})))
+	}
+	return router
+}
+
+// handleNotFoundFile answers with the contents of -404-file, or an empty 404
+// if it can't be read
+func handleNotFoundFile(ctx context.Context, req *Req) *Res {
+	data, err := os.ReadFile(notFoundFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not read 404 file: %s\n", err)
+		return &Res{Status: 404}
+	}
+	return &Res{
+		Status: 404,
+		CType:  "text/html",
+		Body:   data,
+	}
+}
+
+// handleEcho sends back the rest of the path, as text or JSON depending on
+// the accept header, or base64-decoded when the query has encoding=base64
+func handleEcho(ctx context.Context, req *Req) *Res {
+	rest := req.Params["rest"]
+	switch req.Query["encoding"] {
+	case "":
+		switch negotiateMediaType(strings.Join(req.Headers.Values("accept"), ","), []string{"text/plain", "application/json"}) {
+		case "text/plain":
+			return &Res{
+				Status: 200,
+				CType:  "text/plain",
+				Body:   []byte(rest),
+			}
+		case "application/json":
+			return JSONRes(200, map[string]string{"echo": rest})
+		default:
+			return ErrRes(errors.New("Can only echo as text/plain or application/json"), 406)
+		}
+	case "base64":
+		// accept both alphabets, with or without padding
+		enc := base64.RawStdEncoding
+		if strings.ContainsAny(rest, "-_") {
+			enc = base64.RawURLEncoding
+		}
+		data, err := enc.DecodeString(strings.TrimRight(rest, "="))
+		if err != nil {
+			return ErrRes(errors.New("Invalid base64 payload"), 400)
+		}
+		return &Res{
+			Status: 200,
+			CType:  "application/octet-stream",
+			Body:   data,
+		}
+	default:
+		return ErrRes(fmt.Errorf("Unsupported encoding %q", req.Query["encoding"]), 400)
+	}
+}
+
+func handleHealth(ctx context.Context, req *Req) *Res {
+	return JSONRes(200, struct {
+		Status        string `json:"status"`
+		UptimeSeconds int64  `json:"uptime_seconds"`
+		Connections   int64  `json:"connections"`
+	}{
+		Status:        "ok",
+		UptimeSeconds: int64(time.Since(startTime).Seconds()),
+		Connections:   activeConns.Load(),
+	})
+}
+
+// handleOptions answers an OPTIONS request (including CORS preflights) for a
+// path that supports the allowed methods
+func handleOptions(req *Req, allowed []string) *Res {
+	res := &Res{Status: 204}
+	res.SetHeader("allow", strings.Join(allowed, ", "))
+	if corsOrigin != "" {
+		res.SetHeader("access-control-allow-origin", corsOrigin)
+		res.SetHeader("access-control-allow-methods", strings.Join(allowed, ", "))
+		// allow whatever the preflight asks for, the server doesn't restrict headers
+		allowHeaders := req.Headers.Get("access-control-request-headers")
+		if allowHeaders == "" {
+			allowHeaders = "Content-Type"
+		}
+		res.SetHeader("access-control-allow-headers", allowHeaders)
+	}
+	return res
+}
+
+// handleSubmit sends back the parsed request body as JSON, along with the
+// media type it was parsed as
+func handleSubmit(ctx context.Context, req *Req) *Res {
+	body, err := req.ParseBody()
+	if err != nil {
+		return ErrRes(err, errStatus(err, 400))
+	}
+	mt, _, _ := mime.ParseMediaType(req.Headers.Get("content-type"))
+	return JSONRes(200, struct {
+		ContentType string      `json:"content_type"`
+		Body        interface{} `json:"body"`
+	}{mt, body})
+}
+
+// handleUpload stores the files of a multipart/form-data body in directory
+func handleUpload(ctx context.Context, req *Req) *Res {
+	parts, err := req.ParseMultipart()
+	if err != nil {
+		return ErrRes(err, errStatus(err, 400))
+	}
+	stored := []string{}
+	for _, part := range parts {
+		// plain form fields have no file to store
+		if part.Filename == "" {
+			continue
+		}
+		p, ok := safeJoin(directory, part.Filename)
+		if !ok {
+			return &Res{Status: 403}
+		}
+		if res := handleCreateFile(p, part.Data, defaultFileMode, false); res.Status != 201 {
+			return res
+		}
+		stored = append(stored, part.Filename)
+	}
+	return JSONRes(201, map[string][]string{"files": stored})
+}
+
+var errFilesDisabled = errors.New("No files are served here, start the server with -directory or -vhost to serve some")
+
+// filesHandler resolves the requested file inside the root of the mount at
+// prefix before calling fn. For /files/, the -vhost directory of the request's
+// host takes the place of root. Roots must be absolute, as main makes sure
+// they are.
+func filesHandler(prefix, root string, fn func(ctx context.Context, p string, req *Req) *Res) HandlerFunc {
+	return func(ctx context.Context, req *Req) *Res {
+		dir := root
+		if prefix == "/files/" {
+			dir = hostDirectory(req, root)
+		}
+		if dir == "" {
+			return ErrRes(errFilesDisabled, 404)
+		}
+		p, ok := safeJoin(dir, req.Params["name"])
+		if !ok {
+			return &Res{Status: 403}
+		}
+		return fn(ctx, p, req)
+	}
+}
+
+// hostDirectory returns the -vhost directory for the host req is for, or def
+// if there is none
+func hostDirectory(req *Req, def string) string {
+	host := strings.ToLower(req.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if dir, ok := vhosts[host]; ok {
+		return dir
+	}
+	return def
+}
+
+// resolveDir makes dir absolute, checking that it is an existing directory
+func resolveDir(dir string) (string, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	stat, err := os.Stat(abs)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return "", fmt.Errorf("%s does not exist", abs)
+		}
+		return "", err
+	}
+	if !stat.IsDir() {
+		return "", fmt.Errorf("%s is not a directory", abs)
+	}
+	return abs, nil
+}
+
+// configure checks the flags, resolving the directories they name to
+// absolute paths
+func configure() error {
+	if _, ok := mounts["/files/"]; !ok && directory != "" {
+		mounts["/files/"] = directory
+	}
+	if logFormat != "text" && logFormat != "json" {
+		return fmt.Errorf("Invalid log format %q: must be text or json", logFormat)
+	}
+	// port 0 picks any free port
+	if port < 0 || port > 65535 {
+		return fmt.Errorf("Invalid port %d: must be between 0 and 65535", port)
+	}
+	if directory != "" {
+		dir, err := resolveDir(directory)
+		if err != nil {
+			return fmt.Errorf("Invalid -directory: %s", err)
+		}
+		directory = dir
+	}
+	for prefix, root := range mounts {
+		dir, err := resolveDir(root)
+		if err != nil {
+			return fmt.Errorf("Invalid mount %s: %s", prefix, err)
+		}
+		mounts[prefix] = dir
+	}
+	for host, root := range vhosts {
+		dir, err := resolveDir(root)
+		if err != nil {
+			return fmt.Errorf("Invalid vhost %s: %s", host, err)
+		}
+		vhosts[host] = dir
+	}
+	if indexFile != "" && directory == "" && len(vhosts) == 0 {
+		return errors.New("-index needs -directory or -vhost to serve the index from")
+	}
+	if auth != "" && !strings.Contains(auth, ":") {
+		return errors.New("Invalid -auth: must be of the form user:pass")
+	}
+	if (tlsCert == "") != (tlsKey == "") {
+		return errors.New("Both -tls-cert and -tls-key must be given to enable TLS")
+	}
+	return nil
+}
+
+// loadTLSConfig loads the -tls-cert and -tls-key pair, returning nil if TLS
+// isn't enabled
+func loadTLSConfig() (*tls.Config, error) {
+	if tlsCert == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(tlsCert, tlsKey)
+	if err != nil {
+		return nil, fmt.Errorf("Could not load TLS certificate: %s", err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
+
+// listen binds every -listen address and the -unix socket, or -host and
+// -port if neither is given, serving TLS over them if tlsConfig is set
+func listen(tlsConfig *tls.Config) ([]net.Listener, error) {
+	addrs := listenAddrs
+	if len(addrs) == 0 && unixSocket == "" {
+		addrs = listenFlag{net.JoinHostPort(host, strconv.Itoa(port))}
+	}
+	type bind struct{ network, addr string }
+	binds := make([]bind, 0, len(addrs)+1)
+	for _, addr := range addrs {
+		binds = append(binds, bind{"tcp", addr})
+	}
+	if unixSocket != "" {
+		// a socket left behind by a server that didn't shut down cleanly would
+		// make the bind fail. Closing the listener on shutdown removes it. One
+		// that still accepts connections belongs to a running server.
+		if fi, err := os.Lstat(unixSocket); err == nil && fi.Mode()&fs.ModeSocket != 0 {
+			conn, err := net.Dial("unix", unixSocket)
+			if err == nil {
+				conn.Close()
+				return nil, fmt.Errorf("Failed to bind to %s: address in use", unixSocket)
+			}
+			if errors.Is(err, syscall.ECONNREFUSED) {
+				os.Remove(unixSocket)
+			}
+		}
+		binds = append(binds, bind{"unix", unixSocket})
+	}
+
+	listeners := make([]net.Listener, 0, len(binds))
+	for _, b := range binds {
+		server, err := net.Listen(b.network, b.addr)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("Failed to bind to %s: %s", b.addr, err)
+		}
+		// print the address bound rather than the one asked for, which may
+		// have left the port to the system. Only the access log goes to stdout.
+		if tlsConfig != nil {
+			fmt.Fprintf(os.Stderr, "Listening on %s (TLS)\n", server.Addr())
+			server = tls.NewListener(server, tlsConfig)
+		} else {
+			fmt.Fprintf(os.Stderr, "Listening on %s\n", server.Addr())
+		}
+		listeners = append(listeners, server)
+	}
+	return listeners, nil
+}
+
+func main() {
+	// flags are parsed here rather than in init, where they would clash with
+	// the flags of test binaries
+	flag.Parse()
+	if err := configure(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	tlsConfig, err := loadTLSConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	listeners, err := listen(tlsConfig)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	router := newRouter()
+
+	// stop accepting on SIGINT/SIGTERM, closing the listeners unblocks Accept
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		fmt.Fprintf(os.Stderr, "Received %s, shutting down\n", sig)
+		shutdown(listeners)
+	}()
+
+	// connSlots limits the number of connections served at once, across all
+	// listeners
+	var connSlots chan struct{}
+	if maxConns > 0 {
+		connSlots = make(chan struct{}, maxConns)
+	}
+
+	var wg sync.WaitGroup
+	var accepting sync.WaitGroup
+	for _, server := range listeners {
+		accepting.Add(1)
+		go func() {
+			defer accepting.Done()
+			acceptConns(server, router, connSlots, &wg)
+		}()
+	}
+	accepting.Wait()
 
-		go handleConnection(conn)
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(shutdownTimeout):
+		fmt.Fprintln(os.Stderr, "Timed out waiting for connections to finish")
 	}
+	os.Exit(0)
 }
@@ -0,0 +1,2258 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// tests that check the access log point it somewhere else
+	logOutput = io.Discard
+	os.Exit(m.Run())
+}
+
+// set changes *p to v for the duration of the test, for flags and other
+// package state
+func set[T any](t *testing.T, p *T, v T) {
+	t.Helper()
+	old := *p
+	*p = v
+	t.Cleanup(func() { *p = old })
+}
+
+// startServer serves newRouter on an ephemeral local port until the test
+// ends, returning its address. The router is built once the test has set
+// the flags it needs.
+func startServer(t *testing.T) string {
+	t.Helper()
+	return serve(t, newRouter())
+}
+
+// serve serves router on an ephemeral local port until the test ends,
+// returning its address
+func serve(t *testing.T, router *Router) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveListener(t, ln, router, nil)
+	return ln.Addr().String()
+}
+
+// serveListener accepts connections from ln for router until the test ends,
+// then waits for the connections to be done
+func serveListener(t *testing.T, ln net.Listener, router *Router, connSlots chan struct{}) {
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	go func() {
+		acceptConns(ln, router, connSlots, &wg)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		ln.Close()
+		<-done
+		wg.Wait()
+	})
+}
+
+// serveFiles points -directory at a new temporary directory for the
+// duration of the test, returning it
+func serveFiles(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	set(t, &directory, dir)
+	set(t, &mounts, mountFlag{"/files/": dir})
+	return dir
+}
+
+// dial connects to addr, closing the connection when the test ends
+func dial(t *testing.T, addr string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// rawRequest builds an HTTP/1.1 request asking for the connection to be
+// closed after it, with the given "Name: Value" headers and body
+func rawRequest(method, target, body string, headers ...string) string {
+	raw := method + " " + target + " HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n"
+	for _, h := range headers {
+		raw += h + "\r\n"
+	}
+	if body != "" {
+		raw += "Content-Length: " + strconv.Itoa(len(body)) + "\r\n"
+	}
+	return raw + "\r\n" + body
+}
+
+// do sends raw to addr on a new connection and reads back one response
+func do(t *testing.T, addr, raw string) (*http.Response, string) {
+	t.Helper()
+	conn := dial(t, addr)
+	if _, err := io.WriteString(conn, raw); err != nil {
+		t.Fatal(err)
+	}
+	return readResponse(t, bufio.NewReader(conn), raw)
+}
+
+// readResponse reads the response to the request raw from r
+func readResponse(t *testing.T, r *bufio.Reader, raw string) (*http.Response, string) {
+	t.Helper()
+	method, _, _ := strings.Cut(raw, " ")
+	res, err := http.ReadResponse(r, &http.Request{Method: method})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res, string(body)
+}
+
+// roundTrip sends raw to addr on a new connection and returns everything
+// the server writes back until it closes the connection
+func roundTrip(t *testing.T, addr, raw string) string {
+	t.Helper()
+	conn := dial(t, addr)
+	if _, err := io.WriteString(conn, raw); err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestPostLargeFile(t *testing.T) {
+	dir := serveFiles(t)
+	addr := startServer(t)
+	content := make([]byte, 10<<10)
+	for i := range content {
+		content[i] = byte(i * 7)
+	}
+	res, _ := do(t, addr, rawRequest("POST", "/files/big", string(content)))
+	if res.StatusCode != 201 {
+		t.Fatalf("status = %d, want 201", res.StatusCode)
+	}
+	stored, err := os.ReadFile(filepath.Join(dir, "big"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stored, content) {
+		t.Errorf("stored %d bytes differing from the %d sent", len(stored), len(content))
+	}
+}
+
+func TestInvalidContentLength(t *testing.T) {
+	dir := serveFiles(t)
+	addr := startServer(t)
+	for _, cl := range []string{"+3", "-3", " 3x", "0x3", "3, 4"} {
+		raw := "POST /files/x HTTP/1.1\r\nHost: localhost\r\nContent-Length: " + cl + "\r\n\r\nabc"
+		if res, _ := do(t, addr, raw); res.StatusCode != 400 {
+			t.Errorf("content-length %q: status = %d, want 400", cl, res.StatusCode)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "x")); err == nil {
+		t.Error("a body with an invalid content-length was stored")
+	}
+}
+
+func TestUserAgentKeepsCase(t *testing.T) {
+	addr := startServer(t)
+	_, body := do(t, addr, rawRequest("GET", "/user-agent", "", "User-Agent: MyApp/Beta1"))
+	if body != "MyApp/Beta1" {
+		t.Errorf("body = %q, want MyApp/Beta1", body)
+	}
+}
+
+func TestParseRequestMalformedLine(t *testing.T) {
+	for _, raw := range []string{
+		"\r\n\r\n",
+		"GET\r\n\r\n",
+		"GET /\r\n\r\n",
+		" / HTTP/1.1\r\n\r\n",
+		"GET  HTTP/1.1\r\n\r\n",
+	} {
+		_, err := parseRequest([]byte(raw))
+		if status := errStatus(err, 0); status != 400 {
+			t.Errorf("parseRequest(%q) = %v, want a 400 error", raw, err)
+		}
+	}
+}
+
+func TestMalformedLineGets400(t *testing.T) {
+	addr := startServer(t)
+	for _, raw := range []string{"GET\r\n\r\n", "\r\n\r\n"} {
+		res, _ := do(t, addr, raw)
+		if res.StatusCode != 400 {
+			t.Errorf("%q: status = %d, want 400", raw, res.StatusCode)
+		}
+	}
+}
+
+func TestGarbageGetsOneErrorAndClose(t *testing.T) {
+	addr := startServer(t)
+	out := roundTrip(t, addr, "\x00\x01garbage\x7f\r\n\r\n")
+	if n := strings.Count(out, "HTTP/1.1 "); n != 1 || !strings.HasPrefix(out, "HTTP/1.1 400 ") {
+		t.Errorf("got %d responses, want a single 400:\n%s", n, out)
+	}
+	// the server survives to serve the next connection
+	if res, _ := do(t, addr, rawRequest("GET", "/", "")); res.StatusCode != 200 {
+		t.Errorf("status after garbage = %d, want 200", res.StatusCode)
+	}
+}
+
+func TestFilesTraversal(t *testing.T) {
+	parent := t.TempDir()
+	root := filepath.Join(parent, "root")
+	if err := os.Mkdir(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(parent, "secret"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	set(t, &directory, root)
+	set(t, &mounts, mountFlag{"/files/": root})
+	addr := startServer(t)
+
+	for _, target := range []string{"/files/../secret", "/files/a/../../secret", "/files/%2e%2e/secret", "/files/..%2fsecret", "/files/%2E%2E%2Fsecret"} {
+		if res, _ := do(t, addr, rawRequest("GET", target, "")); res.StatusCode != 403 {
+			t.Errorf("GET %s: status = %d, want 403", target, res.StatusCode)
+		}
+		if res, _ := do(t, addr, rawRequest("POST", target+"-new", "pwned")); res.StatusCode != 403 {
+			t.Errorf("POST %s: status = %d, want 403", target, res.StatusCode)
+		}
+		if _, err := os.Stat(filepath.Join(parent, "secret-new")); err == nil {
+			t.Fatalf("POST %s wrote outside the directory", target)
+		}
+	}
+	// absolute paths are resolved inside the directory too
+	for _, target := range []string{"/files//etc/passwd", "/files/%2Fetc%2Fpasswd"} {
+		if res, _ := do(t, addr, rawRequest("GET", target, "")); res.StatusCode != 404 {
+			t.Errorf("GET %s: status = %d, want 404", target, res.StatusCode)
+		}
+	}
+}
+
+func TestKeepAlivePipelined(t *testing.T) {
+	addr := startServer(t)
+	conn := dial(t, addr)
+	first := "GET /echo/one HTTP/1.1\r\nHost: localhost\r\n\r\n"
+	second := rawRequest("GET", "/echo/two", "")
+	if _, err := io.WriteString(conn, first+second); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(conn)
+	res, body := readResponse(t, r, first)
+	if body != "one" || res.Header.Get("Connection") != "keep-alive" {
+		t.Errorf("first response = %q with connection %q, want one with keep-alive", body, res.Header.Get("Connection"))
+	}
+	res, body = readResponse(t, r, second)
+	// ReadResponse moves connection: close into res.Close
+	if body != "two" || !res.Close {
+		t.Errorf("second response = %q, close = %v, want two with close", body, res.Close)
+	}
+}
+
+func TestListenOnEphemeralPort(t *testing.T) {
+	set(t, &host, host)
+	set(t, &port, port)
+	if err := flag.CommandLine.Parse([]string{"-host", "127.0.0.1", "-port", "0"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := configure(); err != nil {
+		t.Fatal(err)
+	}
+	listeners, err := listen(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := listeners[0]
+	serveListener(t, ln, newRouter(), nil)
+
+	addr := ln.Addr().String()
+	if strings.HasSuffix(addr, ":0") {
+		t.Fatalf("listening on %s, want the port the system picked", addr)
+	}
+	if res, _ := do(t, addr, rawRequest("GET", "/", "")); res.StatusCode != 200 {
+		t.Errorf("status = %d, want 200", res.StatusCode)
+	}
+}
+
+func TestConfigureRejectsBadPort(t *testing.T) {
+	for _, p := range []int{-1, 65536} {
+		set(t, &port, p)
+		if err := configure(); err == nil {
+			t.Errorf("configure accepted port %d", p)
+		}
+	}
+}
+
+func TestParseRequestQuery(t *testing.T) {
+	for _, tc := range []struct {
+		target string
+		want   map[string]string
+	}{
+		{"/echo/abc", map[string]string{}},
+		{"/echo/abc?", map[string]string{}},
+		// the first of repeated keys wins
+		{"/echo/abc?x=1&x=2", map[string]string{"x": "1"}},
+		{"/echo/abc?msg=hello%20world%26more&plus=a+b", map[string]string{"msg": "hello world&more", "plus": "a b"}},
+	} {
+		req, err := parseRequest([]byte("GET " + tc.target + " HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+		if err != nil {
+			t.Fatalf("%s: %v", tc.target, err)
+		}
+		if req.Path != "/echo/abc" {
+			t.Errorf("%s: path = %q, want /echo/abc", tc.target, req.Path)
+		}
+		if len(req.Query) != len(tc.want) {
+			t.Errorf("%s: query = %v, want %v", tc.target, req.Query, tc.want)
+		}
+		for k, v := range tc.want {
+			if req.Query[k] != v {
+				t.Errorf("%s: query[%s] = %q, want %q", tc.target, k, req.Query[k], v)
+			}
+		}
+	}
+}
+
+func TestEchoIgnoresQuery(t *testing.T) {
+	addr := startServer(t)
+	if _, body := do(t, addr, rawRequest("GET", "/echo/abc?x=1", "")); body != "abc" {
+		t.Errorf("body = %q, want abc", body)
+	}
+}
+
+func TestParseRequestDecodesPath(t *testing.T) {
+	for target, want := range map[string]string{
+		"/files/my%20file.txt": "/files/my file.txt",
+		// + only means a space in queries
+		"/files/a+b":   "/files/a+b",
+		"/files/a%2Bb": "/files/a+b",
+	} {
+		req, err := parseRequest([]byte("GET " + target + " HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+		if err != nil {
+			t.Fatalf("%s: %v", target, err)
+		}
+		if req.Path != want || req.RawPath != target {
+			t.Errorf("%s: path = %q, raw path = %q, want %q and %q", target, req.Path, req.RawPath, want, target)
+		}
+	}
+	_, err := parseRequest([]byte("GET /files/%zz HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	if status := errStatus(err, 0); status != 400 {
+		t.Errorf("parseRequest of %%zz = %v, want a 400 error", err)
+	}
+}
+
+func TestGetFileWithSpace(t *testing.T) {
+	dir := serveFiles(t)
+	if err := os.WriteFile(filepath.Join(dir, "my file.txt"), []byte("spaced"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	addr := startServer(t)
+	if _, body := do(t, addr, rawRequest("GET", "/files/my%20file.txt", "")); body != "spaced" {
+		t.Errorf("body = %q, want spaced", body)
+	}
+}
+
+func TestPutAndDeleteFiles(t *testing.T) {
+	dir := serveFiles(t)
+	addr := startServer(t)
+	if res, _ := do(t, addr, rawRequest("PUT", "/files/missing", "new")); res.StatusCode != 404 {
+		t.Errorf("PUT of a missing file: status = %d, want 404", res.StatusCode)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "missing")); err == nil {
+		t.Error("PUT created a missing file")
+	}
+
+	p := filepath.Join(dir, "existing")
+	if err := os.WriteFile(p, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if res, _ := do(t, addr, rawRequest("PUT", "/files/existing", "new")); res.StatusCode != 200 {
+		t.Errorf("PUT of an existing file: status = %d, want 200", res.StatusCode)
+	}
+	if b, _ := os.ReadFile(p); string(b) != "new" {
+		t.Errorf("file holds %q after PUT, want new", b)
+	}
+	if res, _ := do(t, addr, rawRequest("DELETE", "/files/existing", "")); res.StatusCode != 204 {
+		t.Errorf("DELETE of an existing file: status = %d, want 204", res.StatusCode)
+	}
+	if _, err := os.Stat(p); err == nil {
+		t.Error("file still exists after DELETE")
+	}
+	if res, _ := do(t, addr, rawRequest("DELETE", "/files/existing", "")); res.StatusCode != 404 {
+		t.Errorf("DELETE of a missing file: status = %d, want 404", res.StatusCode)
+	}
+}
+
+func TestMethodNotAllowedAllow(t *testing.T) {
+	serveFiles(t)
+	addr := startServer(t)
+	for _, tc := range []struct{ method, target, allow string }{
+		{"PUT", "/echo/x", "GET, HEAD, OPTIONS"},
+		{"LOCK", "/files/x", "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS"},
+	} {
+		res, _ := do(t, addr, rawRequest(tc.method, tc.target, ""))
+		if res.StatusCode != 405 || res.Header.Get("Allow") != tc.allow {
+			t.Errorf("%s %s = %d with allow %q, want 405 with %q", tc.method, tc.target, res.StatusCode, res.Header.Get("Allow"), tc.allow)
+		}
+	}
+}
+
+func TestHead(t *testing.T) {
+	dir := serveFiles(t)
+	if err := os.WriteFile(filepath.Join(dir, "existing"), []byte("some content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	addr := startServer(t)
+	for _, target := range []string{"/", "/echo/foo", "/files/existing"} {
+		get, _ := do(t, addr, rawRequest("GET", target, ""))
+		head, _ := do(t, addr, rawRequest("HEAD", target, ""))
+		if head.StatusCode != get.StatusCode {
+			t.Errorf("HEAD %s: status = %d, want %d as for GET", target, head.StatusCode, get.StatusCode)
+		}
+		for _, k := range []string{"Content-Length", "Content-Type"} {
+			if head.Header.Get(k) != get.Header.Get(k) {
+				t.Errorf("HEAD %s: %s = %q, want %q as for GET", target, k, head.Header.Get(k), get.Header.Get(k))
+			}
+		}
+		if out := roundTrip(t, addr, rawRequest("HEAD", target, "")); !strings.HasSuffix(out, "\r\n\r\n") {
+			t.Errorf("HEAD %s sent a body:\n%s", target, out)
+		}
+	}
+}
+
+func TestContentTypeFor(t *testing.T) {
+	for name, want := range map[string]string{
+		"index.html": "text/html",
+		"style.CSS":  "text/css",
+		"app.js":     "text/javascript",
+		"data.json":  "application/json",
+		"logo.png":   "image/png",
+		"notes.txt":  "text/plain",
+		"blob.xyz":   "application/octet-stream",
+		"noext":      "application/octet-stream",
+	} {
+		if got := contentTypeFor(name); got != want {
+			t.Errorf("contentTypeFor(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestServedContentType(t *testing.T) {
+	dir := serveFiles(t)
+	for _, name := range []string{"index.html", "a.xyz"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	addr := startServer(t)
+	for target, want := range map[string]string{
+		"/files/index.html": "text/html; charset=utf-8",
+		"/files/a.xyz":      "application/octet-stream",
+	} {
+		if res, _ := do(t, addr, rawRequest("GET", target, "")); res.Header.Get("Content-Type") != want {
+			t.Errorf("GET %s: content-type = %q, want %q", target, res.Header.Get("Content-Type"), want)
+		}
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	t.Cleanup(func() { shuttingDown.Store(false) })
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started, release := make(chan struct{}), make(chan struct{})
+	rt := newRouter()
+	rt.Handle("GET", "/slow", func(ctx context.Context, req *Req) *Res {
+		close(started)
+		<-release
+		return &Res{Status: 200, Body: []byte("done")}
+	})
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	go func() {
+		acceptConns(ln, rt, nil, &wg)
+		close(done)
+	}()
+	addr := ln.Addr().String()
+
+	// one connection idling after a request, and one in the middle of one
+	idler := dial(t, addr)
+	ping := "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"
+	io.WriteString(idler, ping)
+	readResponse(t, bufio.NewReader(idler), ping)
+	busy := dial(t, addr)
+	slow := "GET /slow HTTP/1.1\r\nHost: localhost\r\n\r\n"
+	io.WriteString(busy, slow)
+	<-started
+
+	start := time.Now()
+	shutdown([]net.Listener{ln})
+	<-done
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Error("new connections are still accepted after shutdown")
+	}
+	idler.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := idler.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Errorf("idle connection read = %v, want EOF right away", err)
+	}
+
+	close(release)
+	r := bufio.NewReader(busy)
+	if _, body := readResponse(t, r, slow); body != "done" {
+		t.Errorf("in-flight request got %q, want done", body)
+	}
+	if _, err := r.ReadByte(); !errors.Is(err, io.EOF) {
+		t.Errorf("busy connection read after its response = %v, want EOF", err)
+	}
+	wg.Wait()
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("shutdown took %s", d)
+	}
+}
+
+func TestStalledHeadersTimeOut(t *testing.T) {
+	set(t, &readTimeout, 100*time.Millisecond)
+	addr := startServer(t)
+	// the headers never end
+	out := roundTrip(t, addr, "GET / HTTP/1.1\r\nHost: localhost\r\n")
+	if !strings.HasPrefix(out, "HTTP/1.1 408 ") {
+		t.Errorf("got %q, want a 408", out)
+	}
+}
+
+func TestStatusText(t *testing.T) {
+	for status, want := range map[uint]string{
+		100: "Continue",
+		204: "No Content",
+		206: "Partial Content",
+		301: "Moved Permanently",
+		302: "Found",
+		304: "Not Modified",
+		401: "Unauthorized",
+		403: "Forbidden",
+		406: "Not Acceptable",
+		408: "Request Timeout",
+		409: "Conflict",
+		412: "Precondition Failed",
+		413: "Payload Too Large",
+		415: "Unsupported Media Type",
+		416: "Range Not Satisfiable",
+		429: "Too Many Requests",
+		431: "Request Header Fields Too Large",
+		503: "Service Unavailable",
+		505: "HTTP Version Not Supported",
+	} {
+		res := &Res{Status: status}
+		if got := res.StatusText(); got != want {
+			t.Errorf("StatusText(%d) = %q, want %q", status, got, want)
+		}
+		if line := fmt.Sprintf("HTTP/1.1 %d %s\r\n", status, want); !strings.HasPrefix(res.String(), line) {
+			t.Errorf("%d renders as %q, want it to start with %q", status, res.String(), line)
+		}
+	}
+}
+
+func TestAutoindex(t *testing.T) {
+	dir := serveFiles(t)
+	if err := os.MkdirAll(filepath.Join(dir, "sub", "nested"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "sub", "<b>x.txt"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("off", func(t *testing.T) {
+		addr := startServer(t)
+		if res, _ := do(t, addr, rawRequest("GET", "/files/sub", "")); res.StatusCode != 404 {
+			t.Errorf("status = %d, want 404", res.StatusCode)
+		}
+	})
+	t.Run("on", func(t *testing.T) {
+		set(t, &autoindex, true)
+		addr := startServer(t)
+		res, body := do(t, addr, rawRequest("GET", "/files/sub", ""))
+		if res.StatusCode != 200 || !strings.HasPrefix(res.Header.Get("Content-Type"), "text/html") {
+			t.Fatalf("status = %d, content-type = %q, want a 200 HTML listing", res.StatusCode, res.Header.Get("Content-Type"))
+		}
+		for _, want := range []string{`<a href="/files/sub/nested">nested/</a>`, `<a href="/files/sub/%3Cb%3Ex.txt">&lt;b&gt;x.txt</a>`} {
+			if !strings.Contains(body, want) {
+				t.Errorf("listing lacks %s:\n%s", want, body)
+			}
+		}
+		if strings.Contains(body, "<b>") {
+			t.Errorf("listing has an unescaped file name:\n%s", body)
+		}
+	})
+}
+
+func TestRange(t *testing.T) {
+	dir := serveFiles(t)
+	if err := os.WriteFile(filepath.Join(dir, "digits"), []byte("0123456789"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	addr := startServer(t)
+	for _, tc := range []struct {
+		rangeHeader  string
+		status       int
+		contentRange string
+		body         string
+	}{
+		{"bytes=2-5", 206, "bytes 2-5/10", "2345"},
+		{"bytes=7-", 206, "bytes 7-9/10", "789"},
+		{"bytes=-3", 206, "bytes 7-9/10", "789"},
+		{"bytes=8-100", 206, "bytes 8-9/10", "89"},
+		{"bytes=10-", 416, "bytes */10", ""},
+		// malformed and multiple ranges are ignored
+		{"bytes=5-2", 200, "", "0123456789"},
+		{"bytes=0-1,3-4", 200, "", "0123456789"},
+	} {
+		res, body := do(t, addr, rawRequest("GET", "/files/digits", "", "Range: "+tc.rangeHeader))
+		if res.StatusCode != tc.status || res.Header.Get("Content-Range") != tc.contentRange {
+			t.Errorf("%s: status = %d, content-range = %q, want %d and %q", tc.rangeHeader, res.StatusCode, res.Header.Get("Content-Range"), tc.status, tc.contentRange)
+		}
+		if tc.status != 416 && (body != tc.body || res.ContentLength != int64(len(tc.body))) {
+			t.Errorf("%s: body = %q of length %d, want %q", tc.rangeHeader, body, res.ContentLength, tc.body)
+		}
+	}
+}
+
+func TestDateHeader(t *testing.T) {
+	fixed := time.Date(2024, 3, 5, 14, 7, 9, 0, time.FixedZone("CET", 3600))
+	set(t, &now, func() time.Time { return fixed })
+	res, err := http.ReadResponse(bufio.NewReader(strings.NewReader((&Res{Status: 200}).String())), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := res.Header.Get("Date"); got != "Tue, 05 Mar 2024 13:07:09 GMT" {
+		t.Errorf("date = %q, want the clock's time in GMT", got)
+	}
+	parsed, err := http.ParseTime(res.Header.Get("Date"))
+	if err != nil || !parsed.Equal(fixed) {
+		t.Errorf("date parses as %v (%v), want %v", parsed, err, fixed)
+	}
+}
+
+func TestServerHeader(t *testing.T) {
+	if got := (&Res{Status: 200}).String(); !strings.Contains(got, "\r\nServer: codecrafters-http-go/"+version+"\r\n") {
+		t.Errorf("response lacks the server header:\n%s", got)
+	}
+	set(t, &noServerHeader, true)
+	if got := (&Res{Status: 200}).String(); strings.Contains(got, "Server:") {
+		t.Errorf("-no-server-header response has a server header:\n%s", got)
+	}
+}
+
+func TestChunkedRequestBody(t *testing.T) {
+	dir := serveFiles(t)
+	addr := startServer(t)
+	for name, chunks := range map[string]string{
+		"single": "b\r\nhello world\r\n0\r\n\r\n",
+		"multi":  "5\r\nhello\r\n1;ext=1\r\n \r\n5\r\nworld\r\n0\r\nX-Trailer: yes\r\n\r\n",
+	} {
+		raw := "POST /files/" + name + " HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\nTransfer-Encoding: chunked\r\n\r\n" + chunks
+		if res, _ := do(t, addr, raw); res.StatusCode != 201 {
+			t.Fatalf("%s: status = %d, want 201", name, res.StatusCode)
+		}
+		if b, _ := os.ReadFile(filepath.Join(dir, name)); string(b) != "hello world" {
+			t.Errorf("%s: stored %q, want hello world", name, b)
+		}
+	}
+
+	// content-length is ignored for the chunks, and the connection closed in
+	// case a proxy in front went by it
+	raw := "POST /files/both HTTP/1.1\r\nHost: localhost\r\nContent-Length: 3\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n"
+	if res, _ := do(t, addr, raw); res.StatusCode != 201 || !res.Close {
+		t.Errorf("with content-length too: status = %d, closing %v, want 201 and a close", res.StatusCode, res.Close)
+	}
+	if b, _ := os.ReadFile(filepath.Join(dir, "both")); string(b) != "hello" {
+		t.Errorf("with content-length too: stored %q, want hello", b)
+	}
+
+	// a body in any other coding has no end, and mustn't be read as a request
+	smuggled := "GET /echo/smuggled HTTP/1.1\r\nHost: localhost\r\n\r\n"
+	out := roundTrip(t, addr, "POST /submit HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: identity\r\n\r\n"+smuggled)
+	if !strings.HasPrefix(out, "HTTP/1.1 400 ") || strings.Count(out, "HTTP/1.1 ") != 1 {
+		t.Errorf("transfer-encoding: identity answered with\n%s\nwant a single 400", out)
+	}
+}
+
+func TestMalformedChunkedBody(t *testing.T) {
+	addr := startServer(t)
+	for _, chunks := range []string{"zz\r\nhello\r\n0\r\n\r\n", "5\r\nhelloXX0\r\n\r\n", "+5\r\nhello\r\n0\r\n\r\n", "0x5\r\nhello\r\n0\r\n\r\n"} {
+		raw := "POST /submit HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n" + chunks
+		if res, _ := do(t, addr, raw); res.StatusCode != 400 {
+			t.Errorf("%q: status = %d, want 400", chunks, res.StatusCode)
+		}
+	}
+}
+
+func TestParseRequestBareLF(t *testing.T) {
+	req, err := parseRequest([]byte("POST /files/x HTTP/1.1\nHost: localhost\nContent-Length: 2\n\nhi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Method != "POST" || req.Path != "/files/x" || req.Headers.Get("Host") != "localhost" || string(req.Body) != "hi" {
+		t.Errorf("parsed %s %s host %q body %q, want POST /files/x host localhost body hi", req.Method, req.Path, req.Headers.Get("Host"), req.Body)
+	}
+}
+
+func TestBareLFRequest(t *testing.T) {
+	addr := startServer(t)
+	got := roundTrip(t, addr, "GET /echo/abc HTTP/1.1\nHost: localhost\nConnection: close\n\n")
+	if !strings.HasPrefix(got, "HTTP/1.1 200 OK\r\n") || !strings.HasSuffix(got, "\r\n\r\nabc") {
+		t.Errorf("response = %q, want a CRLF-framed 200 with body abc", got)
+	}
+}
+
+func TestMounts(t *testing.T) {
+	files, static := t.TempDir(), t.TempDir()
+	os.WriteFile(filepath.Join(files, "a.txt"), []byte("from files"), 0644)
+	os.WriteFile(filepath.Join(static, "a.txt"), []byte("from static"), 0644)
+	set(t, &mounts, mountFlag{})
+	for _, v := range []string{"/files/=" + files, "static=" + static} {
+		if err := mounts.Set(v); err != nil {
+			t.Fatalf("Set(%q): %v", v, err)
+		}
+	}
+	if err := configure(); err != nil {
+		t.Fatal(err)
+	}
+	addr := startServer(t)
+	for target, want := range map[string]string{"/files/a.txt": "from files", "/static/a.txt": "from static"} {
+		if _, body := do(t, addr, rawRequest("GET", target, "")); body != want {
+			t.Errorf("GET %s = %q, want %q", target, body, want)
+		}
+	}
+	if res, _ := do(t, addr, rawRequest("GET", "/staticx/a.txt", "")); res.StatusCode != 404 {
+		t.Errorf("GET /staticx/a.txt = %d, want 404", res.StatusCode)
+	}
+}
+
+func TestDirectoryIsFilesMount(t *testing.T) {
+	dir := t.TempDir()
+	set(t, &directory, dir)
+	set(t, &mounts, mountFlag{})
+	if err := configure(); err != nil {
+		t.Fatal(err)
+	}
+	if len(mounts) != 1 || mounts["/files/"] == "" {
+		t.Errorf("mounts = %v, want just /files/", mounts)
+	}
+	if err := mounts.Set("nope"); err == nil {
+		t.Error("Set accepted a mount without a path")
+	}
+}
+
+func TestValidMethod(t *testing.T) {
+	for method, want := range map[string]bool{
+		"GET":      true,
+		"PROPFIND": true,
+		"M-SEARCH": true,
+		"get":      false,
+		"Get":      false,
+		"":         false,
+		"G\x01T":   false,
+		"G(ET)":    false,
+	} {
+		if got := validMethod(method); got != want {
+			t.Errorf("validMethod(%q) = %t, want %t", method, got, want)
+		}
+	}
+}
+
+func TestInvalidMethodGets400(t *testing.T) {
+	addr := startServer(t)
+	for _, line := range []string{"get / HTTP/1.1", " / HTTP/1.1", "G ET / HTTP/1.1", "GET\t/ HTTP/1.1"} {
+		if res, _ := do(t, addr, line+"\r\nHost: localhost\r\n\r\n"); res.StatusCode != 400 {
+			t.Errorf("%q: status = %d, want 400", line, res.StatusCode)
+		}
+	}
+}
+
+// serveFile writes content to name under a -directory whose file was last
+// modified at mtime, returning the server's address
+func serveFile(t *testing.T, name, content string, mtime time.Time) string {
+	t.Helper()
+	p := filepath.Join(serveFiles(t), name)
+	if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(p, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	return startServer(t)
+}
+
+func TestIfModifiedSince(t *testing.T) {
+	mtime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	addr := serveFile(t, "a.txt", "hello", mtime)
+	res, body := do(t, addr, rawRequest("GET", "/files/a.txt", ""))
+	if res.StatusCode != 200 || body != "hello" {
+		t.Fatalf("GET = %d %q, want 200 hello", res.StatusCode, body)
+	}
+	if got := res.Header.Get("Last-Modified"); got != "Wed, 01 May 2024 12:00:00 GMT" {
+		t.Errorf("last-modified = %q, want Wed, 01 May 2024 12:00:00 GMT", got)
+	}
+	for ims, want := range map[string]int{
+		"Wed, 01 May 2024 12:00:00 GMT": 304,
+		"Thu, 02 May 2024 00:00:00 GMT": 304,
+		"Tue, 30 Apr 2024 12:00:00 GMT": 200,
+		"not a date":                    200,
+	} {
+		res, body := do(t, addr, rawRequest("GET", "/files/a.txt", "", "If-Modified-Since: "+ims))
+		if res.StatusCode != want {
+			t.Errorf("if-modified-since %s: status = %d, want %d", ims, res.StatusCode, want)
+		}
+		if want == 304 && body != "" {
+			t.Errorf("if-modified-since %s: 304 has body %q", ims, body)
+		}
+	}
+}
+
+func TestIfNoneMatch(t *testing.T) {
+	addr := serveFile(t, "a.txt", "hello", time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	res, _ := do(t, addr, rawRequest("GET", "/files/a.txt", ""))
+	etag := res.Header.Get("ETag")
+	if !strings.HasPrefix(etag, `"`) || !strings.HasSuffix(etag, `"`) {
+		t.Fatalf("etag = %q, want a quoted etag", etag)
+	}
+	for inm, want := range map[string]int{
+		etag:               304,
+		"W/" + etag:        304,
+		`"other", ` + etag: 304,
+		"*":                304,
+		`"other"`:          200,
+	} {
+		// if-none-match wins over an if-modified-since that says otherwise
+		res, body := do(t, addr, rawRequest("GET", "/files/a.txt", "", "If-None-Match: "+inm, "If-Modified-Since: Tue, 30 Apr 2024 12:00:00 GMT"))
+		if res.StatusCode != want {
+			t.Errorf("if-none-match %s: status = %d, want %d", inm, res.StatusCode, want)
+		}
+		if want == 304 && (body != "" || res.Header.Get("ETag") != etag) {
+			t.Errorf("if-none-match %s: 304 has body %q and etag %q, want none and %s", inm, body, res.Header.Get("ETag"), etag)
+		}
+	}
+}
+
+func TestClientHangupCancelsHandler(t *testing.T) {
+	returned := make(chan error, 1)
+	rt := newRouter()
+	rt.Handle("GET", "/wait", func(ctx context.Context, req *Req) *Res {
+		select {
+		case <-ctx.Done():
+			returned <- ctx.Err()
+		case <-time.After(5 * time.Second):
+			returned <- errors.New("context never cancelled")
+		}
+		return &Res{Status: 200}
+	})
+	addr := serve(t, rt)
+	conn := dial(t, addr)
+	io.WriteString(conn, "GET /wait HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	time.Sleep(50 * time.Millisecond)
+	// abort the connection, rather than close it for sending only
+	conn.(*net.TCPConn).SetLinger(0)
+	conn.Close()
+	select {
+	case err := <-returned:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("handler returned with %v, want context.Canceled", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("handler still running 2s after the client hung up")
+	}
+}
+
+func TestHalfCloseGetsWholeResponse(t *testing.T) {
+	dir := serveFiles(t)
+	content := bytes.Repeat([]byte("0123456789abcdef"), 1<<20)
+	os.WriteFile(filepath.Join(dir, "big"), content, 0644)
+	addr := startServer(t)
+	conn := dial(t, addr)
+	raw := rawRequest("GET", "/files/big", "")
+	io.WriteString(conn, raw)
+	// the client is done sending, but still reads the response
+	conn.(*net.TCPConn).CloseWrite()
+	res, body := readResponse(t, bufio.NewReader(conn), raw)
+	if res.StatusCode != 200 || body != string(content) {
+		t.Errorf("status = %d with %d of %d bytes after a half-close", res.StatusCode, len(body), len(content))
+	}
+}
+
+func TestContextOutlivesHandler(t *testing.T) {
+	ctxErr := make(chan error, 1)
+	rt := newRouter()
+	rt.Handle("GET", "/ctx", func(ctx context.Context, req *Req) *Res {
+		// a streamed body is read after the handler has returned
+		pr, pw := io.Pipe()
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+			ctxErr <- ctx.Err()
+			pw.Close()
+		}()
+		return &Res{Status: 200, Stream: pr, StreamLen: -1}
+	})
+	addr := serve(t, rt)
+	do(t, addr, rawRequest("GET", "/ctx", ""))
+	if err := <-ctxErr; err != nil {
+		t.Errorf("context during the write = %v, want it still live", err)
+	}
+}
+
+func TestKeepAliveAfterResponse(t *testing.T) {
+	addr := startServer(t)
+	conn := dial(t, addr)
+	r := bufio.NewReader(conn)
+	// each request is only sent once the previous response has arrived, so
+	// the connection is watched while the handler runs
+	for _, word := range []string{"one", "two"} {
+		raw := "GET /echo/" + word + " HTTP/1.1\r\nHost: localhost\r\n\r\n"
+		io.WriteString(conn, raw)
+		if _, body := readResponse(t, r, raw); body != word {
+			t.Errorf("response = %q, want %s", body, word)
+		}
+	}
+}
+
+func TestMaxConns(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveListener(t, ln, newRouter(), make(chan struct{}, 1))
+	addr := ln.Addr().String()
+
+	// a keep-alive connection holds the only slot
+	holder := dial(t, addr)
+	ping := "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"
+	io.WriteString(holder, ping)
+	readResponse(t, bufio.NewReader(holder), ping)
+
+	// the request is sent before reading to the end, as clients do, which
+	// would have the 503 reset if the server didn't read it
+	for range 5 {
+		out := roundTrip(t, addr, rawRequest("GET", "/", ""))
+		if !strings.HasPrefix(out, "HTTP/1.1 503 ") || !strings.Contains(out, "\r\nRetry-After: 1\r\n") {
+			t.Errorf("connection over the limit got\n%s\nwant 503 with retry-after 1", out)
+		}
+	}
+
+	// the slot frees up once the holder hangs up
+	holder.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		res, _ := do(t, addr, rawRequest("GET", "/", ""))
+		if res.StatusCode == 200 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("status after the holder closed = %d, want 200", res.StatusCode)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServiceUnavailable(t *testing.T) {
+	res := ServiceUnavailable(30)
+	if res.Status != 503 || res.StatusText() != "Service Unavailable" || res.Headers["retry-after"] != "30" {
+		t.Errorf("ServiceUnavailable(30) = %d %q with retry-after %q, want 503 Service Unavailable and 30", res.Status, res.StatusText(), res.Headers["retry-after"])
+	}
+	if got := ServiceUnavailable(0).String(); strings.Contains(got, "Retry-After") {
+		t.Errorf("ServiceUnavailable(0) has a retry-after:\n%s", got)
+	}
+}
+
+func TestRepeatedHeadersKeepEveryValue(t *testing.T) {
+	req, err := parseRequest([]byte("GET / HTTP/1.1\r\nHost: localhost\r\nX-Test: one\r\nx-test: two\r\n\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := req.Headers.Values("X-Test"); len(got) != 2 || got[0] != "one" || got[1] != "two" {
+		t.Errorf("x-test values = %q, want [one two]", got)
+	}
+	if got := req.Headers.Get("x-test"); got != "one" {
+		t.Errorf("Get(x-test) = %q, want the first value", got)
+	}
+	if got := req.Headers.Get("x-missing"); got != "" {
+		t.Errorf("Get(x-missing) = %q, want empty", got)
+	}
+}
+
+func TestUpload(t *testing.T) {
+	dir := serveFiles(t)
+	addr := startServer(t)
+	body, ctype := multipartBody(t)
+	res, resBody := do(t, addr, rawRequest("POST", "/upload", body, "Content-Type: "+ctype))
+	if res.StatusCode != 201 || resBody != `{"files":["a.txt"]}` {
+		t.Errorf("upload = %d %s, want 201 listing a.txt", res.StatusCode, resBody)
+	}
+	if b, _ := os.ReadFile(filepath.Join(dir, "a.txt")); string(b) != "file contents" {
+		t.Errorf("stored %q, want file contents", b)
+	}
+}
+
+func TestPreflight(t *testing.T) {
+	preflight := rawRequest("OPTIONS", "/echo/x", "", "Origin: https://example.com", "Access-Control-Request-Method: GET", "Access-Control-Request-Headers: X-Custom")
+	t.Run("no cors", func(t *testing.T) {
+		res, _ := do(t, startServer(t), preflight)
+		if res.StatusCode != 204 || res.Header.Get("Allow") != "GET, HEAD, OPTIONS" {
+			t.Errorf("preflight = %d allowing %q, want 204 allowing GET, HEAD, OPTIONS", res.StatusCode, res.Header.Get("Allow"))
+		}
+		if got := res.Header.Get("Access-Control-Allow-Origin"); got != "" {
+			t.Errorf("preflight without -cors-origin allows origin %q", got)
+		}
+	})
+	t.Run("cors", func(t *testing.T) {
+		set(t, &corsOrigin, "https://example.com")
+		addr := startServer(t)
+		res, _ := do(t, addr, preflight)
+		for name, want := range map[string]string{
+			"Access-Control-Allow-Origin":  "https://example.com",
+			"Access-Control-Allow-Methods": "GET, HEAD, OPTIONS",
+			"Access-Control-Allow-Headers": "X-Custom",
+		} {
+			if got := res.Header.Get(name); got != want {
+				t.Errorf("%s = %q, want %q", name, got, want)
+			}
+		}
+		// plain responses carry the origin too
+		if res, _ := do(t, addr, rawRequest("GET", "/echo/x", "")); res.Header.Get("Access-Control-Allow-Origin") != "https://example.com" {
+			t.Errorf("GET allows origin %q, want https://example.com", res.Header.Get("Access-Control-Allow-Origin"))
+		}
+	})
+}
+
+func TestNoContentHasNoBody(t *testing.T) {
+	for _, status := range []uint{204, 304} {
+		got := (&Res{Status: status, Body: []byte("ignored")}).String()
+		if strings.Contains(strings.ToLower(got), "content-length") || !strings.HasSuffix(got, "\r\n\r\n") {
+			t.Errorf("%d renders with a content-length or body:\n%q", status, got)
+		}
+	}
+	if got := (&Res{Status: 200}).String(); !strings.Contains(got, "\r\nContent-Length: 0\r\n") {
+		t.Errorf("an empty 200 lacks content-length: 0:\n%q", got)
+	}
+}
+
+func TestHTTPVersions(t *testing.T) {
+	for proto, want := range map[string]error{"HTTP/1.0": nil, "HTTP/1.1": nil, "HTTP/2.0": errVersionNotSupported} {
+		req, err := parseRequest([]byte("GET / " + proto + "\r\nHost: localhost\r\n\r\n"))
+		if err != want {
+			t.Errorf("%s: err = %v, want %v", proto, err, want)
+			continue
+		}
+		if err == nil && req.Proto != proto {
+			t.Errorf("%s: proto = %q", proto, req.Proto)
+		}
+	}
+
+	addr := startServer(t)
+	if got := roundTrip(t, addr, "GET /echo/x HTTP/2.0\r\nHost: localhost\r\n\r\n"); !strings.HasPrefix(got, "HTTP/1.1 505 HTTP Version Not Supported\r\n") {
+		t.Errorf("HTTP/2.0 request got %q, want a 505", got)
+	}
+	// HTTP/1.0 closes after the response unless asked to keep alive
+	if got := roundTrip(t, addr, "GET /echo/x HTTP/1.0\r\n\r\n"); !strings.HasPrefix(got, "HTTP/1.1 200 OK\r\n") || !strings.HasSuffix(got, "\r\n\r\nx") {
+		t.Errorf("HTTP/1.0 request got %q, want a 200 then close", got)
+	}
+}
+
+func TestVersionNotSupportedRenders(t *testing.T) {
+	_, err := parseRequest([]byte("GET / HTTP/3\r\n\r\n"))
+	res := ErrRes(err, errStatus(err, 422))
+	if got := res.String(); !strings.HasPrefix(got, "HTTP/1.1 505 HTTP Version Not Supported\r\n") {
+		t.Errorf("unsupported version renders as %q, want a 505 status line", got)
+	}
+}
+
+func TestEchoBase64(t *testing.T) {
+	addr := startServer(t)
+	want := "\x00\x01\x02\xff\xfe"
+	for _, payload := range []string{"AAEC//4=", "AAEC//4", "AAEC__4"} {
+		res, body := do(t, addr, rawRequest("GET", "/echo/"+payload+"?encoding=base64", ""))
+		if res.StatusCode != 200 || body != want || res.Header.Get("Content-Type") != "application/octet-stream" {
+			t.Errorf("%s: %d %s %q, want 200 application/octet-stream %q", payload, res.StatusCode, res.Header.Get("Content-Type"), body, want)
+		}
+	}
+	for _, target := range []string{"/echo/!!notbase64?encoding=base64", "/echo/abc?encoding=rot13"} {
+		if res, _ := do(t, addr, rawRequest("GET", target, "")); res.StatusCode != 400 {
+			t.Errorf("%s: status = %d, want 400", target, res.StatusCode)
+		}
+	}
+}
+
+func TestHealth(t *testing.T) {
+	set(t, &startTime, time.Now().Add(-90*time.Second))
+	addr := startServer(t)
+	res, body := do(t, addr, rawRequest("GET", "/health", ""))
+	var health struct {
+		Status        string `json:"status"`
+		UptimeSeconds int64  `json:"uptime_seconds"`
+		Connections   int64  `json:"connections"`
+	}
+	if err := json.Unmarshal([]byte(body), &health); err != nil || res.StatusCode != 200 {
+		t.Fatalf("/health = %d %s (%v), want 200 with a JSON body", res.StatusCode, body, err)
+	}
+	// the request asking is one of the connections
+	if health.Status != "ok" || health.UptimeSeconds < 90 || health.UptimeSeconds > 100 || health.Connections < 1 {
+		t.Errorf("/health = %+v, want ok, about 90s up and at least 1 connection", health)
+	}
+}
+
+func TestCreateIfNoneMatch(t *testing.T) {
+	dir := serveFiles(t)
+	addr := startServer(t)
+	if res, _ := do(t, addr, rawRequest("POST", "/files/new", "first", "If-None-Match: *")); res.StatusCode != 201 {
+		t.Fatalf("creating an absent file = %d, want 201", res.StatusCode)
+	}
+	if res, _ := do(t, addr, rawRequest("POST", "/files/new", "second", "If-None-Match: *")); res.StatusCode != 412 {
+		t.Errorf("creating a present file = %d, want 412", res.StatusCode)
+	}
+	if b, _ := os.ReadFile(filepath.Join(dir, "new")); string(b) != "first" {
+		t.Errorf("file holds %q after the refused write, want first", b)
+	}
+}
+
+func TestUpdateIfMatch(t *testing.T) {
+	dir := serveFiles(t)
+	os.WriteFile(filepath.Join(dir, "a.txt"), []byte("v1"), 0644)
+	addr := startServer(t)
+	res, _ := do(t, addr, rawRequest("GET", "/files/a.txt", ""))
+	etag := res.Header.Get("ETag")
+	if res, _ := do(t, addr, rawRequest("PUT", "/files/a.txt", "v2", `If-Match: "stale"`)); res.StatusCode != 412 {
+		t.Errorf("PUT with a stale if-match = %d, want 412", res.StatusCode)
+	}
+	if res, _ := do(t, addr, rawRequest("PUT", "/files/missing", "v2", "If-Match: *")); res.StatusCode != 412 {
+		t.Errorf("PUT of a missing file with if-match = %d, want 412", res.StatusCode)
+	}
+	if res, _ := do(t, addr, rawRequest("PUT", "/files/a.txt", "v2", "If-Match: "+etag)); res.StatusCode != 200 {
+		t.Errorf("PUT with the current etag = %d, want 200", res.StatusCode)
+	}
+}
+
+func TestCreateFileMode(t *testing.T) {
+	dir := serveFiles(t)
+	addr := startServer(t)
+	for name, want := range map[string]fs.FileMode{"default": 0644, "custom?mode=0640": 0640} {
+		if res, _ := do(t, addr, rawRequest("POST", "/files/"+name, "x")); res.StatusCode != 201 {
+			t.Fatalf("POST %s = %d, want 201", name, res.StatusCode)
+		}
+		name, _, _ = strings.Cut(name, "?")
+		stat, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stat.Mode().Perm() != want {
+			t.Errorf("%s: mode = %v, want %v", name, stat.Mode().Perm(), want)
+		}
+	}
+	// not octal, out of range, unreadable by the owner, writable by others
+	for _, mode := range []string{"0x1ff", "9", "01000", "0200", "0666"} {
+		if res, _ := do(t, addr, rawRequest("POST", "/files/bad?mode="+mode, "x")); res.StatusCode != 400 {
+			t.Errorf("mode %s: status = %d, want 400", mode, res.StatusCode)
+		}
+	}
+}
+
+func TestCreatedLocation(t *testing.T) {
+	serveFiles(t)
+	addr := startServer(t)
+	res, _ := do(t, addr, rawRequest("POST", "/files/my%20file.txt?mode=0640", "x"))
+	if res.StatusCode != 201 || res.Header.Get("Location") != "/files/my%20file.txt" {
+		t.Errorf("POST = %d with location %q, want 201 and /files/my%%20file.txt", res.StatusCode, res.Header.Get("Location"))
+	}
+}
+
+func TestControlCharsInTarget(t *testing.T) {
+	dir := serveFiles(t)
+	addr := startServer(t)
+	for _, target := range []string{"/files/q\rSet-Cookie:pwn=1", "/files/a\tb", "/files/\x7f", "/files/a\x00"} {
+		got := roundTrip(t, addr, "POST "+target+" HTTP/1.1\r\nHost: localhost\r\nContent-Length: 1\r\n\r\nx")
+		if !strings.HasPrefix(got, "HTTP/1.1 400 ") || strings.Contains(got, "pwn") {
+			t.Errorf("%q got %q, want a plain 400", target, got)
+		}
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("created %d files, want none", len(entries))
+	}
+}
+
+// writeSelfSigned writes a self-signed certificate for 127.0.0.1 and its key
+// to dir, returning their paths and the certificate
+func writeSelfSigned(t *testing.T, dir string) (certFile, keyFile string, cert *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return certFile, keyFile, cert
+}
+
+func TestTLS(t *testing.T) {
+	certFile, keyFile, cert := writeSelfSigned(t, t.TempDir())
+	set(t, &tlsCert, certFile)
+	set(t, &tlsKey, keyFile)
+	set(t, &listenAddrs, listenFlag{"127.0.0.1:0"})
+	tlsConfig, err := loadTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	listeners, err := listen(tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveListener(t, listeners[0], newRouter(), nil)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	conn, err := tls.Dial("tcp", listeners[0].Addr().String(), &tls.Config{RootCAs: roots})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	raw := rawRequest("GET", "/", "")
+	io.WriteString(conn, raw)
+	if res, _ := readResponse(t, bufio.NewReader(conn), raw); res.StatusCode != 200 {
+		t.Errorf("status over TLS = %d, want 200", res.StatusCode)
+	}
+}
+
+func TestLoadTLSConfigFails(t *testing.T) {
+	set(t, &tlsCert, filepath.Join(t.TempDir(), "missing.pem"))
+	set(t, &tlsKey, tlsCert)
+	if _, err := loadTLSConfig(); err == nil {
+		t.Error("loadTLSConfig accepted a missing certificate")
+	}
+}
+
+func TestExpectContinue(t *testing.T) {
+	dir := serveFiles(t)
+	addr := startServer(t)
+	conn := dial(t, addr)
+	io.WriteString(conn, "POST /files/x HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\nExpect: 100-continue\r\nContent-Length: 5\r\n\r\n")
+	r := bufio.NewReader(conn)
+	interim := make([]byte, len("HTTP/1.1 100 Continue\r\n\r\n"))
+	if _, err := io.ReadFull(r, interim); err != nil || string(interim) != "HTTP/1.1 100 Continue\r\n\r\n" {
+		t.Fatalf("before the body, read %q (%v), want a 100 Continue", interim, err)
+	}
+	io.WriteString(conn, "hello")
+	if res, _ := readResponse(t, r, "POST"); res.StatusCode != 201 {
+		t.Errorf("status = %d, want 201", res.StatusCode)
+	}
+	if b, _ := os.ReadFile(filepath.Join(dir, "x")); string(b) != "hello" {
+		t.Errorf("stored %q, want hello", b)
+	}
+}
+
+func TestWriteToCountsBytes(t *testing.T) {
+	var b bytes.Buffer
+	n, err := benchRes().WriteTo(&b)
+	if err != nil || n != int64(b.Len()) || !bytes.HasSuffix(b.Bytes(), make([]byte, 1<<20)) {
+		t.Errorf("WriteTo = %d, %v writing %d bytes, want every byte counted and the body last", n, err, b.Len())
+	}
+}
+
+// benchRes is a response with a body large enough for copying it to matter
+func benchRes() *Res {
+	return &Res{Status: 200, CType: "application/octet-stream", Body: make([]byte, 1<<20)}
+}
+
+func BenchmarkWriteTo(b *testing.B) {
+	res := benchRes()
+	b.ReportAllocs()
+	b.SetBytes(int64(len(res.Body)))
+	for i := 0; i < b.N; i++ {
+		res.WriteTo(io.Discard)
+	}
+}
+
+// BenchmarkString writes the response the way it was before WriteTo,
+// rendered into one string first
+func BenchmarkString(b *testing.B) {
+	res := benchRes()
+	b.ReportAllocs()
+	b.SetBytes(int64(len(res.Body)))
+	for i := 0; i < b.N; i++ {
+		io.WriteString(io.Discard, res.String())
+	}
+}
+
+func TestGetLargeFile(t *testing.T) {
+	content := make([]byte, 4<<20)
+	for i := range content {
+		content[i] = byte(i * 31)
+	}
+	dir := serveFiles(t)
+	os.WriteFile(filepath.Join(dir, "big"), content, 0644)
+	addr := startServer(t)
+	res, body := do(t, addr, rawRequest("GET", "/files/big", ""))
+	if res.ContentLength != int64(len(content)) || body != string(content) {
+		t.Errorf("got %d bytes with content-length %d, want the %d bytes of the file", len(body), res.ContentLength, len(content))
+	}
+}
+
+func TestFileStreamStopsOnCancel(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "big")
+	os.WriteFile(p, make([]byte, 1<<20), 0644)
+	ctx, cancel := context.WithCancel(context.Background())
+	res := handleSendFile(ctx, p, newReq("GET", "/files/big"))
+	defer res.Stream.Close()
+	if _, err := res.Stream.Read(make([]byte, 1024)); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if n, err := io.Copy(io.Discard, res.Stream); !errors.Is(err, context.Canceled) {
+		t.Errorf("after cancel, read %d more bytes with %v, want context.Canceled", n, err)
+	}
+}
+
+func TestPermissionDeniedIs403(t *testing.T) {
+	err := &fs.PathError{Op: "open", Path: "/x", Err: fs.ErrPermission}
+	if res := fileErrRes(err); res.Status != 403 || res.StatusText() != "Forbidden" {
+		t.Errorf("fileErrRes(permission denied) = %d %s, want 403 Forbidden", res.Status, res.StatusText())
+	}
+
+	if os.Geteuid() == 0 {
+		t.Skip("root can read files whatever their mode")
+	}
+	dir := serveFiles(t)
+	os.WriteFile(filepath.Join(dir, "locked"), []byte("x"), 0)
+	addr := startServer(t)
+	for target, want := range map[string]int{"/files/locked": 403, "/files/missing": 404} {
+		if res, _ := do(t, addr, rawRequest("GET", target, "")); res.StatusCode != want {
+			t.Errorf("GET %s = %d, want %d", target, res.StatusCode, want)
+		}
+	}
+}
+
+func TestBodyLimit(t *testing.T) {
+	serveFiles(t)
+	set(t, &maxBodyBytes, 10)
+	addr := startServer(t)
+	for body, want := range map[string]int{"0123456789": 201, "0123456789x": 413} {
+		if res, _ := do(t, addr, rawRequest("POST", "/files/x", body)); res.StatusCode != want {
+			t.Errorf("%d byte body: status = %d, want %d", len(body), res.StatusCode, want)
+		}
+	}
+	for chunks, want := range map[string]int{
+		"5\r\n01234\r\n5\r\n56789\r\n0\r\n\r\n":  201,
+		"5\r\n01234\r\n6\r\n56789x\r\n0\r\n\r\n": 413,
+	} {
+		raw := "POST /files/x HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\nTransfer-Encoding: chunked\r\n\r\n" + chunks
+		if res, _ := do(t, addr, raw); res.StatusCode != want {
+			t.Errorf("chunks %q: status = %d, want %d", chunks, res.StatusCode, want)
+		}
+	}
+}
+
+func TestChunkedFramingIsBounded(t *testing.T) {
+	set(t, &maxHeaderBytes, 1<<10)
+	addr := startServer(t)
+	long := strings.Repeat("x", 4<<10)
+	for _, chunks := range []string{
+		// an endless chunk extension
+		"1;ext=" + long + "\r\nx\r\n0\r\n\r\n",
+		// endless trailers, in one line and in many
+		"1\r\nx\r\n0\r\nX-Trailer: " + long + "\r\n\r\n",
+		"1\r\nx\r\n0\r\n" + strings.Repeat("X-Trailer: y\r\n", 200) + "\r\n",
+	} {
+		raw := "POST /submit HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n" + chunks
+		if res, _ := do(t, addr, raw); res.StatusCode != 431 {
+			t.Errorf("%.40q...: status = %d, want 431", chunks, res.StatusCode)
+		}
+	}
+}
+
+func TestTooLargeClosesConnection(t *testing.T) {
+	set(t, &maxBodyBytes, 4)
+	addr := startServer(t)
+	// keep-alive is asked for, but the rest of the body can't be skipped
+	got := roundTrip(t, addr, "POST /submit HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\nhello")
+	if !strings.HasPrefix(got, "HTTP/1.1 413 Payload Too Large\r\n") || !strings.Contains(got, "\r\nConnection: close\r\n") {
+		t.Errorf("oversized body got %q, want a 413 closing the connection", got)
+	}
+}
+
+func TestPipelinedWithBodies(t *testing.T) {
+	serveFiles(t)
+	addr := startServer(t)
+	conn := dial(t, addr)
+	reqs := []string{
+		"POST /files/a HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\nhello",
+		"GET /files/a HTTP/1.1\r\nHost: localhost\r\n\r\n",
+		rawRequest("GET", "/echo/three", ""),
+	}
+	if _, err := io.WriteString(conn, strings.Join(reqs, "")); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(conn)
+	for i, want := range []struct {
+		status int
+		body   string
+	}{{201, ""}, {200, "hello"}, {200, "three"}} {
+		res, body := readResponse(t, r, reqs[i])
+		if res.StatusCode != want.status || body != want.body {
+			t.Errorf("response %d = %d %q, want %d %q", i, res.StatusCode, body, want.status, want.body)
+		}
+	}
+}
+
+func TestDefaultCharset(t *testing.T) {
+	dir := serveFiles(t)
+	os.WriteFile(filepath.Join(dir, "a.bin"), []byte("x"), 0644)
+	for charset, want := range map[string]string{"utf-8": "text/plain; charset=utf-8", "": "text/plain"} {
+		t.Run("charset "+charset, func(t *testing.T) {
+			set(t, &defaultCharset, charset)
+			addr := startServer(t)
+			if res, _ := do(t, addr, rawRequest("GET", "/echo/x", "")); res.Header.Get("Content-Type") != want {
+				t.Errorf("echo content-type = %q, want %q", res.Header.Get("Content-Type"), want)
+			}
+			if res, _ := do(t, addr, rawRequest("GET", "/files/a.bin", "")); res.Header.Get("Content-Type") != "application/octet-stream" {
+				t.Errorf("file content-type = %q, want application/octet-stream", res.Header.Get("Content-Type"))
+			}
+		})
+	}
+	if got := withCharset("text/html; charset=latin1"); got != "text/html; charset=latin1" {
+		t.Errorf("withCharset replaced an explicit charset: %q", got)
+	}
+}
+
+func TestNotFoundFile(t *testing.T) {
+	page := filepath.Join(t.TempDir(), "404.html")
+	os.WriteFile(page, []byte("<h1>gone</h1>"), 0644)
+	set(t, &notFoundFile, page)
+	addr := startServer(t)
+	res, body := do(t, addr, rawRequest("GET", "/nope", ""))
+	if res.StatusCode != 404 || body != "<h1>gone</h1>" || !strings.HasPrefix(res.Header.Get("Content-Type"), "text/html") {
+		t.Errorf("GET /nope = %d %s %q, want the custom html 404", res.StatusCode, res.Header.Get("Content-Type"), body)
+	}
+
+	// a missing page falls back to the empty 404
+	os.Remove(page)
+	if res, body := do(t, addr, rawRequest("GET", "/nope", "")); res.StatusCode != 404 || body != "" {
+		t.Errorf("GET /nope without the page = %d %q, want an empty 404", res.StatusCode, body)
+	}
+}
+
+func TestRedirect(t *testing.T) {
+	for status, want := range map[uint]string{301: "Moved Permanently", 302: "Found"} {
+		got := Redirect(status, "/new?x=1").String()
+		if !strings.HasPrefix(got, fmt.Sprintf("HTTP/1.1 %d %s\r\n", status, want)) || !strings.Contains(got, "\r\nLocation: /new?x=1\r\n") {
+			t.Errorf("Redirect(%d) renders as:\n%s", status, got)
+		}
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	set(t, &idleTimeout, 100*time.Millisecond)
+	addr := startServer(t)
+	conn := dial(t, addr)
+	ping := "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"
+	io.WriteString(conn, ping)
+	r := bufio.NewReader(conn)
+	if res, _ := readResponse(t, r, ping); res.Close {
+		t.Fatal("keep-alive request was answered with connection: close")
+	}
+	start := time.Now()
+	if _, err := r.ReadByte(); !errors.Is(err, io.EOF) {
+		t.Errorf("read on the idle connection = %v, want EOF", err)
+	}
+	if d := time.Since(start); d < 80*time.Millisecond || d > 2*time.Second {
+		t.Errorf("idle connection closed after %s, want about 100ms", d)
+	}
+}
+
+func TestEchoAccept(t *testing.T) {
+	addr := startServer(t)
+	for accept, want := range map[string]struct{ ctype, body string }{
+		"application/json": {"application/json", `{"echo":"foo"}`},
+		"text/plain":       {"text/plain; charset=utf-8", "foo"},
+		"*/*":              {"text/plain; charset=utf-8", "foo"},
+	} {
+		res, body := do(t, addr, rawRequest("GET", "/echo/foo", "", "Accept: "+accept))
+		if res.StatusCode != 200 || res.Header.Get("Content-Type") != want.ctype || body != want.body {
+			t.Errorf("accept %s: %d %s %q, want 200 %s %q", accept, res.StatusCode, res.Header.Get("Content-Type"), body, want.ctype, want.body)
+		}
+	}
+	if res, _ := do(t, addr, rawRequest("GET", "/echo/foo", "", "Accept: image/png")); res.StatusCode != 406 {
+		t.Errorf("accept image/png: status = %d, want 406", res.StatusCode)
+	}
+}
+
+func TestNotAcceptableRenders(t *testing.T) {
+	addr := startServer(t)
+	got := roundTrip(t, addr, rawRequest("GET", "/echo/foo", "", "Accept: application/xml"))
+	if !strings.HasPrefix(got, "HTTP/1.1 406 Not Acceptable\r\n") {
+		t.Errorf("impossible accept got %q, want a 406 Not Acceptable", got)
+	}
+}
+
+func TestIndex(t *testing.T) {
+	t.Run("absent", func(t *testing.T) {
+		if res, body := do(t, startServer(t), rawRequest("GET", "/", "")); res.StatusCode != 200 || body != "" {
+			t.Errorf("GET / = %d %q, want an empty 200", res.StatusCode, body)
+		}
+	})
+	t.Run("configured", func(t *testing.T) {
+		dir := serveFiles(t)
+		os.WriteFile(filepath.Join(dir, "index.html"), []byte("<h1>home</h1>"), 0644)
+		set(t, &indexFile, "index.html")
+		res, body := do(t, startServer(t), rawRequest("GET", "/", ""))
+		if res.StatusCode != 200 || body != "<h1>home</h1>" || res.Header.Get("Content-Type") != "text/html; charset=utf-8" {
+			t.Errorf("GET / = %d %s %q, want the index as html", res.StatusCode, res.Header.Get("Content-Type"), body)
+		}
+	})
+	t.Run("configured but missing", func(t *testing.T) {
+		serveFiles(t)
+		set(t, &indexFile, "index.html")
+		if res, _ := do(t, startServer(t), rawRequest("GET", "/", "")); res.StatusCode != 404 {
+			t.Errorf("GET / = %d, want 404", res.StatusCode)
+		}
+	})
+}
+
+func TestPanicGets500(t *testing.T) {
+	rt := newRouter()
+	rt.Handle("GET", "/boom", func(ctx context.Context, req *Req) *Res {
+		var s []int
+		_ = s[1]
+		return nil
+	})
+	addr := serve(t, rt)
+	conn := dial(t, addr)
+	ping := "GET /boom HTTP/1.1\r\nHost: localhost\r\n\r\n"
+	io.WriteString(conn, ping+ping)
+	r := bufio.NewReader(conn)
+	// the connection survives to answer the next request
+	for i := 0; i < 2; i++ {
+		if res, _ := readResponse(t, r, ping); res.StatusCode != 500 {
+			t.Errorf("response %d: status = %d, want 500", i, res.StatusCode)
+		}
+	}
+}
+
+// checksumStream yields body, filling in the x-checksum trailer once it has
+// all been read
+type checksumStream struct {
+	io.Reader
+	trailers map[string]string
+	sum      int
+}
+
+func (s *checksumStream) Read(p []byte) (int, error) {
+	n, err := s.Reader.Read(p)
+	for _, c := range p[:n] {
+		s.sum += int(c)
+	}
+	if errors.Is(err, io.EOF) {
+		s.trailers["x-checksum"] = strconv.Itoa(s.sum)
+	}
+	return n, err
+}
+
+func (s *checksumStream) Close() error { return nil }
+
+func TestChunkedResponse(t *testing.T) {
+	body := strings.Repeat("chunk of body ", 5000)
+	rt := newRouter()
+	rt.Handle("GET", "/stream", func(ctx context.Context, req *Req) *Res {
+		// the name is declared up front, the value filled in at the end
+		trailers := map[string]string{"x-checksum": ""}
+		stream := &checksumStream{Reader: strings.NewReader(body), trailers: trailers}
+		return &Res{Status: 200, Stream: stream, StreamLen: -1, Trailers: trailers}
+	})
+	addr := serve(t, rt)
+	res, got := do(t, addr, rawRequest("GET", "/stream", ""))
+	if len(res.TransferEncoding) != 1 || res.TransferEncoding[0] != "chunked" || res.ContentLength != -1 {
+		t.Errorf("transfer-encoding = %q, content-length = %d, want chunked without a length", res.TransferEncoding, res.ContentLength)
+	}
+	if got != body {
+		t.Errorf("reassembled %d bytes, want the %d streamed", len(got), len(body))
+	}
+	sum := 0
+	for _, c := range []byte(body) {
+		sum += int(c)
+	}
+	// ReadResponse moves the declared trailer names from the header into
+	// res.Trailer, and fills in their values at the end of the body
+	if len(res.Trailer) != 1 || res.Trailer.Get("X-Checksum") != strconv.Itoa(sum) {
+		t.Errorf("trailers = %v, want X-Checksum: %d", res.Trailer, sum)
+	}
+
+	// HTTP/1.0 can't decode chunks, so the body is ended by closing instead
+	raw := roundTrip(t, addr, "GET /stream HTTP/1.0\r\n\r\n")
+	if head, rest, _ := strings.Cut(raw, "\r\n\r\n"); strings.Contains(head, "chunked") || rest != body {
+		t.Errorf("HTTP/1.0 got headers %q and %d bytes, want the raw body until close", head, len(rest))
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	for _, tc := range []struct {
+		header  string
+		trusted string
+	}{
+		{"X-Forwarded-For: 203.0.113.7", "203.0.113.7"},
+		// the client forged the first entry, the proxy appended the second
+		{"X-Forwarded-For: 1.2.3.4, 203.0.113.7", "203.0.113.7"},
+		{`Forwarded: for=1.2.3.4, for="[2001:db8::1]:4711";proto=https`, "2001:db8::1"},
+		{"Forwarded: proto=http;for=198.51.100.2", "198.51.100.2"},
+		{"X-Other: 1", "10.0.0.9"},
+	} {
+		req := newReq("GET", "/")
+		req.RemoteAddr = "10.0.0.9:5555"
+		name, value, _ := strings.Cut(tc.header, ": ")
+		req.Headers.Add(name, value)
+		set(t, &trustProxy, false)
+		if got := clientIP(req); got != "10.0.0.9" {
+			t.Errorf("untrusted %s: client ip = %q, want the peer's", tc.header, got)
+		}
+		set(t, &trustProxy, true)
+		if got := clientIP(req); got != tc.trusted {
+			t.Errorf("trusted %s: client ip = %q, want %q", tc.header, got, tc.trusted)
+		}
+	}
+}
+
+func TestCanonicalHeaderKeys(t *testing.T) {
+	for k, want := range map[string]string{
+		"content-type":     "Content-Type",
+		"x-request-id":     "X-Request-ID",
+		"ETAG":             "ETag",
+		"www-authenticate": "WWW-Authenticate",
+		"x-custom-thing":   "X-Custom-Thing",
+	} {
+		if got := canonicalHeaderKey(k); got != want {
+			t.Errorf("canonicalHeaderKey(%q) = %q, want %q", k, got, want)
+		}
+	}
+	res := &Res{Status: 200, CType: "text/plain"}
+	res.SetHeader("X-CUSTOM-thing", "1")
+	// lookups don't care how the name was spelled
+	if res.Headers["x-custom-thing"] != "1" {
+		t.Errorf("headers = %v, want x-custom-thing stored lowercase", res.Headers)
+	}
+	for _, line := range []string{"\r\nContent-Type: text/plain", "\r\nX-Custom-Thing: 1\r\n", "\r\nContent-Length: 0\r\n"} {
+		if got := res.String(); !strings.Contains(got, line) {
+			t.Errorf("response lacks %q:\n%s", line, got)
+		}
+	}
+	// headers the server sets itself are replaced however they were spelled
+	res = &Res{Status: 200, Headers: map[string]string{"Content-Length": "99"}, Body: []byte("{}")}
+	if got := res.String(); strings.Count(got, "\r\nContent-Length:") != 1 || !strings.Contains(got, "\r\nContent-Length: 2\r\n") {
+		t.Errorf("response should carry one Content-Length: 2:\n%s", got)
+	}
+}
+
+func TestDirectoryValues(t *testing.T) {
+	set(t, &mounts, mountFlag{})
+	set(t, &directory, "")
+	t.Run("empty", func(t *testing.T) {
+		if err := configure(); err != nil {
+			t.Fatal(err)
+		}
+		res, body := do(t, startServer(t), rawRequest("GET", "/files/a.txt", ""))
+		if res.StatusCode != 404 || body != errFilesDisabled.Error() {
+			t.Errorf("GET without -directory = %d %q, want 404 %q", res.StatusCode, body, errFilesDisabled)
+		}
+	})
+	t.Run("relative", func(t *testing.T) {
+		wd, _ := os.Getwd()
+		rel, err := filepath.Rel(wd, t.TempDir())
+		if err != nil {
+			t.Skip(err)
+		}
+		set(t, &directory, rel)
+		set(t, &mounts, mountFlag{})
+		if err := configure(); err != nil {
+			t.Fatal(err)
+		}
+		if !filepath.IsAbs(directory) || !filepath.IsAbs(mounts["/files/"]) {
+			t.Errorf("-directory %s resolved to %q and mount %q, want absolute paths", rel, directory, mounts["/files/"])
+		}
+	})
+	t.Run("nonexistent", func(t *testing.T) {
+		set(t, &directory, filepath.Join(t.TempDir(), "missing"))
+		set(t, &mounts, mountFlag{})
+		if err := configure(); err == nil || !strings.Contains(err.Error(), "does not exist") {
+			t.Errorf("configure = %v, want a does not exist error", err)
+		}
+	})
+	t.Run("file", func(t *testing.T) {
+		p := filepath.Join(t.TempDir(), "f")
+		os.WriteFile(p, nil, 0644)
+		set(t, &directory, p)
+		set(t, &mounts, mountFlag{})
+		if err := configure(); err == nil || !strings.Contains(err.Error(), "is not a directory") {
+			t.Errorf("configure = %v, want an is not a directory error", err)
+		}
+	})
+}
+
+func TestDeleteDirectories(t *testing.T) {
+	dir := serveFiles(t)
+	os.WriteFile(filepath.Join(dir, "a.txt"), nil, 0644)
+	os.Mkdir(filepath.Join(dir, "empty"), 0755)
+	os.MkdirAll(filepath.Join(dir, "full", "sub"), 0755)
+	os.WriteFile(filepath.Join(dir, "full", "sub", "b.txt"), nil, 0644)
+	addr := startServer(t)
+	for _, tc := range []struct {
+		target string
+		want   int
+		gone   bool
+	}{
+		{"/files/a.txt", 204, true},
+		{"/files/empty", 204, true},
+		{"/files/full", 409, false},
+		{"/files/full?recursive=true", 204, true},
+		// the mount itself can't go
+		{"/files/?recursive=true", 403, false},
+	} {
+		if res, _ := do(t, addr, rawRequest("DELETE", tc.target, "")); res.StatusCode != tc.want {
+			t.Errorf("DELETE %s = %d, want %d", tc.target, res.StatusCode, tc.want)
+		}
+		name, _, _ := strings.Cut(strings.TrimPrefix(tc.target, "/files/"), "?")
+		if _, err := os.Stat(filepath.Join(dir, name)); errors.Is(err, fs.ErrNotExist) != tc.gone {
+			t.Errorf("after DELETE %s: stat = %v, want gone = %t", tc.target, err, tc.gone)
+		}
+	}
+}
+
+func TestConflictRenders(t *testing.T) {
+	dir := serveFiles(t)
+	os.MkdirAll(filepath.Join(dir, "full"), 0755)
+	os.WriteFile(filepath.Join(dir, "full", "x"), nil, 0644)
+	got := roundTrip(t, startServer(t), rawRequest("DELETE", "/files/full", ""))
+	if !strings.HasPrefix(got, "HTTP/1.1 409 Conflict\r\n") {
+		t.Errorf("deleting a full directory got %q, want a 409 Conflict", got)
+	}
+}
+
+func TestMethodOverride(t *testing.T) {
+	dir := serveFiles(t)
+	p := filepath.Join(dir, "a.txt")
+	override := rawRequest("POST", "/files/a.txt", "posted", "X-HTTP-Method-Override: DELETE")
+	t.Run("off", func(t *testing.T) {
+		os.WriteFile(p, []byte("kept"), 0644)
+		// the POST meant as a DELETE is refused, not run as a POST
+		if res, _ := do(t, startServer(t), override); res.StatusCode != 400 {
+			t.Errorf("status = %d, want 400", res.StatusCode)
+		}
+		if b, err := os.ReadFile(p); err != nil || string(b) != "kept" {
+			t.Errorf("file holds %q (%v), want it left alone", b, err)
+		}
+	})
+	t.Run("on", func(t *testing.T) {
+		set(t, &allowMethodOverride, true)
+		addr := startServer(t)
+		if res, _ := do(t, addr, override); res.StatusCode != 204 {
+			t.Errorf("status = %d, want 204", res.StatusCode)
+		}
+		if _, err := os.Stat(p); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("stat after the overridden DELETE = %v, want the file gone", err)
+		}
+		if res, _ := do(t, addr, rawRequest("POST", "/files/a.txt", "", "X-HTTP-Method-Override: CONNECT")); res.StatusCode != 400 {
+			t.Errorf("overriding with CONNECT = %d, want 400", res.StatusCode)
+		}
+	})
+}
+
+func TestPatchAppends(t *testing.T) {
+	dir := serveFiles(t)
+	p := filepath.Join(dir, "log.txt")
+	os.WriteFile(p, []byte("one\n"), 0644)
+	addr := startServer(t)
+	appendHeaders := []string{"Content-Type: application/octet-stream", "X-Append: true"}
+	if res, _ := do(t, addr, rawRequest("PATCH", "/files/log.txt", "two\n", appendHeaders...)); res.StatusCode != 200 {
+		t.Errorf("append = %d, want 200", res.StatusCode)
+	}
+	if b, _ := os.ReadFile(p); string(b) != "one\ntwo\n" {
+		t.Errorf("file holds %q, want one and two", b)
+	}
+	for _, tc := range []struct {
+		target  string
+		headers []string
+		want    int
+	}{
+		{"/files/missing", appendHeaders, 404},
+		{"/files/log.txt", []string{"Content-Type: application/octet-stream"}, 400},
+		{"/files/log.txt", []string{"Content-Type: text/plain", "X-Append: true"}, 415},
+	} {
+		if res, _ := do(t, addr, rawRequest("PATCH", tc.target, "x", tc.headers...)); res.StatusCode != tc.want {
+			t.Errorf("PATCH %s with %q = %d, want %d", tc.target, tc.headers, res.StatusCode, tc.want)
+		}
+	}
+	if b, _ := os.ReadFile(p); string(b) != "one\ntwo\n" {
+		t.Errorf("refused patches changed the file to %q", b)
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	set(t, &writeTimeout, 100*time.Millisecond)
+	rt := newRouter()
+	rt.Handle("GET", "/huge", func(ctx context.Context, req *Req) *Res {
+		// far more than the socket buffers hold
+		return &Res{Status: 200, Body: make([]byte, 64<<20)}
+	})
+	addr := serve(t, rt)
+	before := activeConns.Load()
+	conn := dial(t, addr)
+	// ask for the body, then never read it
+	io.WriteString(conn, "GET /huge HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	waitFor := func(what string, cond func() bool) {
+		t.Helper()
+		for deadline := time.Now().Add(2 * time.Second); !cond(); time.Sleep(5 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s after 2s", what)
+			}
+		}
+	}
+	waitFor("connection never served", func() bool { return activeConns.Load() > before })
+	waitFor("server still writing to a client that doesn't read", func() bool { return activeConns.Load() == before })
+}
+
+func TestTrace(t *testing.T) {
+	t.Run("disabled", func(t *testing.T) {
+		res, _ := do(t, startServer(t), rawRequest("TRACE", "/echo/x", ""))
+		if res.StatusCode != 405 || res.Header.Get("Allow") != "GET, HEAD, OPTIONS" {
+			t.Errorf("TRACE = %d allowing %q, want 405 allowing GET, HEAD, OPTIONS", res.StatusCode, res.Header.Get("Allow"))
+		}
+	})
+	t.Run("enabled", func(t *testing.T) {
+		set(t, &allowTrace, true)
+		addr := startServer(t)
+		res, body := do(t, addr, rawRequest("TRACE", "/echo/x?q=1", "", "X-Test: yes", "Authorization: Basic c2VjcmV0"))
+		want := "TRACE /echo/x?q=1 HTTP/1.1\r\nConnection: close\r\nHost: localhost\r\nX-Test: yes\r\n\r\n"
+		if res.StatusCode != 200 || res.Header.Get("Content-Type") != "message/http" || body != want {
+			t.Errorf("TRACE = %d %s %q, want 200 message/http %q", res.StatusCode, res.Header.Get("Content-Type"), body, want)
+		}
+		// TRACE is answered everywhere, so it is allowed everywhere
+		if res, _ := do(t, addr, rawRequest("PUT", "/echo/x", "")); res.Header.Get("Allow") != "GET, HEAD, TRACE, OPTIONS" {
+			t.Errorf("405 allows %q, want GET, HEAD, TRACE, OPTIONS", res.Header.Get("Allow"))
+		}
+		if res, _ := do(t, addr, rawRequest("OPTIONS", "/echo/x", "")); res.Header.Get("Allow") != "GET, HEAD, TRACE, OPTIONS" {
+			t.Errorf("OPTIONS allows %q, want GET, HEAD, TRACE, OPTIONS", res.Header.Get("Allow"))
+		}
+		if res, _ := do(t, addr, rawRequest("OPTIONS", "*", "")); !strings.Contains(res.Header.Get("Allow"), "TRACE") {
+			t.Errorf("OPTIONS * allows %q, want TRACE among them", res.Header.Get("Allow"))
+		}
+	})
+	t.Run("rate limited", func(t *testing.T) {
+		fakeClock(t)
+		set(t, &allowTrace, true)
+		set(t, &rateLimit, 1)
+		set(t, &rateBurst, 1)
+		addr := startServer(t)
+		var statuses []int
+		for range 3 {
+			res, _ := do(t, addr, rawRequest("TRACE", "/", ""))
+			statuses = append(statuses, res.StatusCode)
+		}
+		if fmt.Sprint(statuses) != "[200 429 429]" {
+			t.Errorf("statuses = %v, want a 200 then 429s", statuses)
+		}
+	})
+}
+
+func TestCloseIsCleanEOF(t *testing.T) {
+	addr := startServer(t)
+	conn := dial(t, addr)
+	// the trailing bytes are still unread when the server closes
+	raw := rawRequest("GET", "/echo/x", "") + "GET /echo/ignored HTTP/1.1\r\n\r\n"
+	io.WriteString(conn, raw)
+	r := bufio.NewReader(conn)
+	if _, body := readResponse(t, r, raw); body != "x" {
+		t.Fatalf("body = %q, want x", body)
+	}
+	// rather than a reset from closing with unread data
+	if b, err := r.ReadByte(); !errors.Is(err, io.EOF) {
+		t.Errorf("read after the response = %q, %v, want a clean EOF", b, err)
+	}
+}
+
+func TestExtraHeaders(t *testing.T) {
+	set(t, &extraHeaders, headerFlag{})
+	for _, v := range []string{"X-Frame-Options: DENY", "Strict-Transport-Security: max-age=63072000", "Content-Type: text/x-default"} {
+		if err := extraHeaders.Set(v); err != nil {
+			t.Fatalf("Set(%q): %v", v, err)
+		}
+	}
+	for _, v := range []string{"Content-Length: 5", "no colon", ": nameless"} {
+		if err := extraHeaders.Set(v); err == nil {
+			t.Errorf("Set(%q) was accepted", v)
+		}
+	}
+	serveFiles(t)
+	addr := startServer(t)
+	for _, target := range []string{"/", "/echo/x", "/nope", "/files/missing"} {
+		res, _ := do(t, addr, rawRequest("GET", target, ""))
+		if res.Header.Get("X-Frame-Options") != "DENY" || res.Header.Get("Strict-Transport-Security") != "max-age=63072000" {
+			t.Errorf("GET %s lacks the injected headers:\n%v", target, res.Header)
+		}
+	}
+	// responses with a content-type of their own keep it
+	if res, _ := do(t, addr, rawRequest("GET", "/echo/x", "")); res.Header.Get("Content-Type") != "text/plain; charset=utf-8" {
+		t.Errorf("echo content-type = %q, want its own", res.Header.Get("Content-Type"))
+	}
+	if res, _ := do(t, addr, rawRequest("GET", "/", "")); res.Header.Get("Content-Type") != "text/x-default" {
+		t.Errorf("root content-type = %q, want the injected default", res.Header.Get("Content-Type"))
+	}
+}
+
+func TestContentTypeInHeaders(t *testing.T) {
+	res := &Res{Status: 200, Body: []byte("{}")}
+	res.SetHeader("Content-Type", "application/json")
+	if got := res.String(); !strings.Contains(got, "\r\nContent-Type: application/json\r\n") || strings.Count(got, "Content-Type") != 1 {
+		t.Errorf("content-type set in headers doesn't survive once:\n%s", got)
+	}
+	// CType wins when both are set
+	res.CType = "application/xml"
+	if got := res.String(); !strings.Contains(got, "\r\nContent-Type: application/xml\r\n") || strings.Count(got, "Content-Type") != 1 {
+		t.Errorf("CType doesn't replace the headers' content-type:\n%s", got)
+	}
+	// a map filled in directly may spell the names any way
+	res = &Res{Status: 200, Body: []byte("{}"), Headers: map[string]string{"Content-Length": "99", "Content-Type": "application/json"}}
+	got := res.String()
+	if strings.Count(got, "Content-Length") != 1 || !strings.Contains(got, "\r\nContent-Length: 2\r\n") {
+		t.Errorf("content-length set in headers isn't replaced:\n%s", got)
+	}
+	if strings.Count(got, "Content-Type") != 1 || !strings.Contains(got, "\r\nContent-Type: application/json\r\n") {
+		t.Errorf("content-type set in headers doesn't survive once:\n%s", got)
+	}
+}
+
+func TestCacheControl(t *testing.T) {
+	dir := serveFiles(t)
+	os.WriteFile(filepath.Join(dir, "a.txt"), []byte("x"), 0644)
+	os.Mkdir(filepath.Join(dir, "sub"), 0755)
+	set(t, &cacheControl, "max-age=3600")
+	set(t, &autoindex, true)
+	addr := startServer(t)
+	for target, want := range map[string]string{
+		"/files/a.txt":   "max-age=3600",
+		"/files/sub":     "no-cache",
+		"/files/missing": "",
+	} {
+		if res, _ := do(t, addr, rawRequest("GET", target, "")); res.Header.Get("Cache-Control") != want {
+			t.Errorf("GET %s: cache-control = %q, want %q", target, res.Header.Get("Cache-Control"), want)
+		}
+	}
+}
+
+func TestSubmit(t *testing.T) {
+	addr := startServer(t)
+	for _, tc := range []struct {
+		ctype, body, want string
+	}{
+		{"application/json", `{"a":[1,2]}`, `{"content_type":"application/json","body":{"a":[1,2]}}`},
+		{"application/x-www-form-urlencoded", "a=1&a=2", `{"content_type":"application/x-www-form-urlencoded","body":{"a":["1","2"]}}`},
+		{"text/plain; charset=utf-8", "hi", `{"content_type":"text/plain","body":"hi"}`},
+	} {
+		res, body := do(t, addr, rawRequest("POST", "/submit", tc.body, "Content-Type: "+tc.ctype))
+		if res.StatusCode != 200 || body != tc.want {
+			t.Errorf("%s: %d %s, want 200 %s", tc.ctype, res.StatusCode, body, tc.want)
+		}
+	}
+	if res, _ := do(t, addr, rawRequest("POST", "/submit", "{", "Content-Type: application/json")); res.StatusCode != 400 {
+		t.Errorf("malformed JSON = %d, want 400", res.StatusCode)
+	}
+	if res, _ := do(t, addr, rawRequest("POST", "/unregistered", "x")); res.StatusCode != 404 {
+		t.Errorf("POST /unregistered = %d, want 404", res.StatusCode)
+	}
+}
+
+func TestRequestTargetForms(t *testing.T) {
+	for _, tc := range []struct {
+		line, host, path string
+	}{
+		{"GET /echo/x?a=1 HTTP/1.1", "example.com", "/echo/x"},
+		{"GET http://other.test:8080/echo/x?a=1 HTTP/1.1", "other.test:8080", "/echo/x"},
+		{"GET HTTPS://other.test HTTP/1.1", "other.test", "/"},
+		{"GET http://other.test?a=1 HTTP/1.1", "other.test", "/"},
+		{"OPTIONS * HTTP/1.1", "example.com", "*"},
+	} {
+		req, err := parseRequest([]byte(tc.line + "\r\nHost: example.com\r\n\r\n"))
+		if err != nil {
+			t.Errorf("%s: %v", tc.line, err)
+			continue
+		}
+		if req.Host != tc.host || req.Path != tc.path {
+			t.Errorf("%s: host %q path %q, want %q and %q", tc.line, req.Host, req.Path, tc.host, tc.path)
+		}
+	}
+	for _, line := range []string{
+		"CONNECT example.com:443 HTTP/1.1",
+		"GET * HTTP/1.1",
+		"GET ftp://example.com/x HTTP/1.1",
+		"GET http:///x HTTP/1.1",
+		"GET http://user@example.com/x HTTP/1.1",
+	} {
+		if _, err := parseRequest([]byte(line + "\r\nHost: example.com\r\n\r\n")); errStatus(err, 0) != 400 {
+			t.Errorf("%s: err = %v, want a 400 error", line, err)
+		}
+	}
+}
+
+func TestHostHeader(t *testing.T) {
+	for _, tc := range []struct {
+		raw  string
+		host string
+		ok   bool
+	}{
+		{"GET / HTTP/1.1\r\nHost: Example.com:8080\r\n\r\n", "Example.com:8080", true},
+		{"GET / HTTP/1.1\r\n\r\n", "", false},
+		{"GET / HTTP/1.1\r\nHost: \r\n\r\n", "", false},
+		{"GET / HTTP/1.1\r\nHost: a.test\r\nHost: b.test\r\n\r\n", "", false},
+		// HTTP/1.0 predates the host header
+		{"GET / HTTP/1.0\r\n\r\n", "", true},
+	} {
+		req, err := parseRequest([]byte(tc.raw))
+		if !tc.ok {
+			if errStatus(err, 0) != 400 {
+				t.Errorf("%q: err = %v, want a 400 error", tc.raw, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tc.raw, err)
+		} else if req.Host != tc.host {
+			t.Errorf("%q: host %q, want %q", tc.raw, req.Host, tc.host)
+		}
+	}
+}
+
+func TestVirtualHosts(t *testing.T) {
+	def := serveFiles(t)
+	a, b := t.TempDir(), t.TempDir()
+	for dir, content := range map[string]string{def: "default", a: "from a", b: "from b"} {
+		os.WriteFile(filepath.Join(dir, "page"), []byte(content), 0644)
+	}
+	v := vhostFlag{}
+	v.Set("A.test=" + a)
+	v.Set("b.test=" + b)
+	set(t, &vhosts, v)
+	if err := configure(); err != nil {
+		t.Fatal(err)
+	}
+	addr := startServer(t)
+	for host, want := range map[string]string{"a.test": "from a", "a.TEST:4221": "from a", "b.test": "from b", "c.test": "default"} {
+		raw := "GET /files/page HTTP/1.1\r\nHost: " + host + "\r\nConnection: close\r\n\r\n"
+		if _, body := do(t, addr, raw); body != want {
+			t.Errorf("host %s: body = %q, want %q", host, body, want)
+		}
+	}
+}
+
+func TestMaxHeaderBytes(t *testing.T) {
+	set(t, &maxHeaderBytes, 1<<10)
+	addr := startServer(t)
+	if res, _ := do(t, addr, rawRequest("GET", "/", "", "X-Pad: "+strings.Repeat("x", 512))); res.StatusCode != 200 {
+		t.Errorf("headers under the limit: status = %d, want 200", res.StatusCode)
+	}
+	for name, header := range map[string]string{
+		"one long header": "X-Pad: " + strings.Repeat("x", 2<<10),
+		"many headers":    strings.TrimSuffix(strings.Repeat("X-Pad: xxxxxxxx\r\n", 100), "\r\n"),
+	} {
+		if res, _ := do(t, addr, rawRequest("GET", "/", "", header)); res.StatusCode != 431 {
+			t.Errorf("%s: status = %d, want 431", name, res.StatusCode)
+		}
+	}
+}
+
+func TestHeadersTooLargeReason(t *testing.T) {
+	set(t, &maxHeaderBytes, 1<<10)
+	addr := startServer(t)
+	out := roundTrip(t, addr, rawRequest("GET", "/", "", "X-Pad: "+strings.Repeat("x", 2<<10)))
+	if want := "HTTP/1.1 431 Request Header Fields Too Large\r\n"; !strings.HasPrefix(out, want) {
+		t.Errorf("response starts %.50q, want %q", out, want)
+	}
+}
+
+func TestMultipleListeners(t *testing.T) {
+	set(t, &listenAddrs, listenFlag{"127.0.0.1:0", "127.0.0.1:0"})
+	listeners, err := listen(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listeners) != 2 {
+		t.Fatalf("bound %d listeners, want 2", len(listeners))
+	}
+	router := newRouter()
+	for _, ln := range listeners {
+		serveListener(t, ln, router, nil)
+	}
+	for _, ln := range listeners {
+		if _, body := do(t, ln.Addr().String(), rawRequest("GET", "/echo/hi", "")); body != "hi" {
+			t.Errorf("%s: body = %q, want hi", ln.Addr(), body)
+		}
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "server.sock")
+	set(t, &unixSocket, sock)
+	listeners, err := listen(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listeners) != 1 {
+		t.Fatalf("bound %d listeners, want only the socket", len(listeners))
+	}
+	serveListener(t, listeners[0], newRouter(), nil)
+
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	raw := rawRequest("GET", "/", "")
+	io.WriteString(conn, raw)
+	if res, _ := readResponse(t, bufio.NewReader(conn), raw); res.StatusCode != 200 {
+		t.Errorf("status over the socket = %d, want 200", res.StatusCode)
+	}
+
+	// a second server can't take the socket from the running one
+	if ls, err := listen(nil); err == nil {
+		ls[0].Close()
+		t.Errorf("listening on a socket in use succeeded")
+	}
+	if _, err := os.Lstat(sock); err != nil {
+		t.Errorf("socket in use was removed: %v", err)
+	}
+
+	listeners[0].Close()
+	if _, err := os.Lstat(sock); !os.IsNotExist(err) {
+		t.Errorf("socket file left behind after closing: %v", err)
+	}
+}
+
+func TestStaleUnixSocket(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "server.sock")
+	set(t, &unixSocket, sock)
+	// a server that went away without removing its socket
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: sock, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.SetUnlinkOnClose(false)
+	ln.Close()
+
+	listeners, err := listen(nil)
+	if err != nil {
+		t.Fatalf("listening over a stale socket: %v", err)
+	}
+	listeners[0].Close()
+}
+
+func TestHeadContentLength(t *testing.T) {
+	dir := serveFiles(t)
+	content := strings.Repeat("some content ", 100)
+	os.WriteFile(filepath.Join(dir, "page.txt"), []byte(content), 0644)
+	addr := startServer(t)
+	for _, ae := range []string{"", "gzip"} {
+		get, body := do(t, addr, rawRequest("GET", "/files/page.txt", "", "Accept-Encoding: "+ae))
+		head, _ := do(t, addr, rawRequest("HEAD", "/files/page.txt", "", "Accept-Encoding: "+ae))
+		if get.ContentLength != int64(len(body)) || head.ContentLength != get.ContentLength {
+			t.Errorf("accepting %q: HEAD content-length = %d, GET = %d for a %d byte body",
+				ae, head.ContentLength, get.ContentLength, len(body))
+		}
+	}
+}
+
+func TestDisableMethods(t *testing.T) {
+	dir := serveFiles(t)
+	p := filepath.Join(dir, "a.txt")
+	t.Run("POST", func(t *testing.T) {
+		set(t, &disabledMethods, methodsFlag{"POST"})
+		addr := startServer(t)
+		res, _ := do(t, addr, rawRequest("POST", "/files/a.txt", "posted"))
+		if res.StatusCode != 405 || strings.Contains(res.Header.Get("Allow"), "POST") {
+			t.Errorf("status = %d allowing %q, want 405 without POST", res.StatusCode, res.Header.Get("Allow"))
+		}
+		if _, err := os.Stat(p); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("stat after the refused POST = %v, want no file", err)
+		}
+	})
+	t.Run("POST overridden", func(t *testing.T) {
+		set(t, &disabledMethods, methodsFlag{"POST"})
+		set(t, &allowMethodOverride, true)
+		os.WriteFile(p, []byte("kept"), 0644)
+		addr := startServer(t)
+		if res, _ := do(t, addr, rawRequest("POST", "/files/a.txt", "", "X-HTTP-Method-Override: DELETE")); res.StatusCode != 405 {
+			t.Errorf("status = %d, want 405", res.StatusCode)
+		}
+		if b, err := os.ReadFile(p); err != nil || string(b) != "kept" {
+			t.Errorf("file holds %q (%v), want it kept", b, err)
+		}
+	})
+	t.Run("GET", func(t *testing.T) {
+		set(t, &disabledMethods, methodsFlag{"GET"})
+		addr := startServer(t)
+		for _, method := range []string{"GET", "HEAD"} {
+			res, _ := do(t, addr, rawRequest(method, "/echo/x", ""))
+			if allow := res.Header.Get("Allow"); res.StatusCode != 405 || strings.Contains(allow, "GET") || strings.Contains(allow, "HEAD") {
+				t.Errorf("%s: status = %d allowing %q, want 405 without GET or HEAD", method, res.StatusCode, allow)
+			}
+		}
+	})
+}